@@ -21,6 +21,53 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type NoticeKind int32
+
+const (
+	NoticeKind_NOTICE_KIND_UNSPECIFIED NoticeKind = 0
+	// the server stops serving the stream, the client should reconnect, to another server if it knows one
+	NoticeKind_NOTICE_KIND_DRAINING NoticeKind = 1
+)
+
+// Enum value maps for NoticeKind.
+var (
+	NoticeKind_name = map[int32]string{
+		0: "NOTICE_KIND_UNSPECIFIED",
+		1: "NOTICE_KIND_DRAINING",
+	}
+	NoticeKind_value = map[string]int32{
+		"NOTICE_KIND_UNSPECIFIED": 0,
+		"NOTICE_KIND_DRAINING":    1,
+	}
+)
+
+func (x NoticeKind) Enum() *NoticeKind {
+	p := new(NoticeKind)
+	*p = x
+	return p
+}
+
+func (x NoticeKind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (NoticeKind) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_gitstafette_proto_enumTypes[0].Descriptor()
+}
+
+func (NoticeKind) Type() protoreflect.EnumType {
+	return &file_api_v1_gitstafette_proto_enumTypes[0]
+}
+
+func (x NoticeKind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use NoticeKind.Descriptor instead.
+func (NoticeKind) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{0}
+}
+
 type WebhookEventStatusRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
@@ -186,13 +233,26 @@ func (x *WebhookEventStatusResponse) GetStatus() string {
 }
 
 type WebhookEventsRequest struct {
-	state               protoimpl.MessageState `protogen:"open.v1"`
-	ClientId            string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
-	RepositoryId        string                 `protobuf:"bytes,2,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
-	LastReceivedEventId uint64                 `protobuf:"varint,3,opt,name=last_received_event_id,json=lastReceivedEventId,proto3" json:"last_received_event_id,omitempty"`
-	DurationSecs        uint32                 `protobuf:"varint,4,opt,name=duration_secs,json=durationSecs,proto3" json:"duration_secs,omitempty"`
-	unknownFields       protoimpl.UnknownFields
-	sizeCache           protoimpl.SizeCache
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	ClientId string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	// an ID, full name (owner/name), or pattern (owner/*) matching the full names of several repositories
+	RepositoryId string `protobuf:"bytes,2,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
+	// the sequence of the last event the client processed, events after it are sent again even if already relayed.
+	// Sequences are per repository, so this only applies when repository_id is not a pattern.
+	LastReceivedEventId uint64 `protobuf:"varint,3,opt,name=last_received_event_id,json=lastReceivedEventId,proto3" json:"last_received_event_id,omitempty"`
+	// how long the stream lives, zero keeps it open until the client closes it or the server asks it to reconnect
+	DurationSecs uint32 `protobuf:"varint,4,opt,name=duration_secs,json=durationSecs,proto3" json:"duration_secs,omitempty"`
+	// more repositories to fetch on the same stream, like repository_id, each event tells which repository it is for
+	RepositoryIds []string `protobuf:"bytes,5,rep,name=repository_ids,json=repositoryIds,proto3" json:"repository_ids,omitempty"`
+	// the client understands the payload of the responses, without it the server only sets webhook_events
+	TypedResponses bool `protobuf:"varint,6,opt,name=typed_responses,json=typedResponses,proto3" json:"typed_responses,omitempty"`
+	// the sequence of the last event the client processed per repository ID, to resume after when reconnecting.
+	// Unlike last_received_event_id these apply to the repositories matched by patterns as well.
+	Cursors map[string]uint64 `protobuf:"bytes,7,rep,name=cursors,proto3" json:"cursors,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// the client acknowledges the events once it stored them, until then they are sent again on every new stream
+	AcknowledgeEvents bool `protobuf:"varint,8,opt,name=acknowledge_events,json=acknowledgeEvents,proto3" json:"acknowledge_events,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
 }
 
 func (x *WebhookEventsRequest) Reset() {
@@ -253,6 +313,34 @@ func (x *WebhookEventsRequest) GetDurationSecs() uint32 {
 	return 0
 }
 
+func (x *WebhookEventsRequest) GetRepositoryIds() []string {
+	if x != nil {
+		return x.RepositoryIds
+	}
+	return nil
+}
+
+func (x *WebhookEventsRequest) GetTypedResponses() bool {
+	if x != nil {
+		return x.TypedResponses
+	}
+	return false
+}
+
+func (x *WebhookEventsRequest) GetCursors() map[string]uint64 {
+	if x != nil {
+		return x.Cursors
+	}
+	return nil
+}
+
+func (x *WebhookEventsRequest) GetAcknowledgeEvents() bool {
+	if x != nil {
+		return x.AcknowledgeEvents
+	}
+	return false
+}
+
 type WebhookEventPushResponse struct {
 	state               protoimpl.MessageState `protogen:"open.v1"`
 	ResponseCode        string                 `protobuf:"bytes,1,opt,name=response_code,json=responseCode,proto3" json:"response_code,omitempty"`
@@ -374,8 +462,15 @@ func (x *WebhookEventPushRequest) GetWebhookEvent() *WebhookEvent {
 }
 
 type WebhookEventsResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	WebhookEvents []*WebhookEvent        `protobuf:"bytes,1,rep,name=webhook_events,json=webhookEvents,proto3" json:"webhook_events,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the events for clients not requesting typed_responses, which take a response without events as heartbeat
+	WebhookEvents []*WebhookEvent `protobuf:"bytes,1,rep,name=webhook_events,json=webhookEvents,proto3" json:"webhook_events,omitempty"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*WebhookEventsResponse_Events
+	//	*WebhookEventsResponse_Heartbeat
+	//	*WebhookEventsResponse_Notice
+	Payload       isWebhookEventsResponse_Payload `protobuf_oneof:"payload"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -417,18 +512,224 @@ func (x *WebhookEventsResponse) GetWebhookEvents() []*WebhookEvent {
 	return nil
 }
 
-type WebhookEvent struct {
+func (x *WebhookEventsResponse) GetPayload() isWebhookEventsResponse_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *WebhookEventsResponse) GetEvents() *WebhookEventBatch {
+	if x != nil {
+		if x, ok := x.Payload.(*WebhookEventsResponse_Events); ok {
+			return x.Events
+		}
+	}
+	return nil
+}
+
+func (x *WebhookEventsResponse) GetHeartbeat() *Heartbeat {
+	if x != nil {
+		if x, ok := x.Payload.(*WebhookEventsResponse_Heartbeat); ok {
+			return x.Heartbeat
+		}
+	}
+	return nil
+}
+
+func (x *WebhookEventsResponse) GetNotice() *ServerNotice {
+	if x != nil {
+		if x, ok := x.Payload.(*WebhookEventsResponse_Notice); ok {
+			return x.Notice
+		}
+	}
+	return nil
+}
+
+type isWebhookEventsResponse_Payload interface {
+	isWebhookEventsResponse_Payload()
+}
+
+type WebhookEventsResponse_Events struct {
+	Events *WebhookEventBatch `protobuf:"bytes,2,opt,name=events,proto3,oneof"`
+}
+
+type WebhookEventsResponse_Heartbeat struct {
+	Heartbeat *Heartbeat `protobuf:"bytes,3,opt,name=heartbeat,proto3,oneof"`
+}
+
+type WebhookEventsResponse_Notice struct {
+	Notice *ServerNotice `protobuf:"bytes,4,opt,name=notice,proto3,oneof"`
+}
+
+func (*WebhookEventsResponse_Events) isWebhookEventsResponse_Payload() {}
+
+func (*WebhookEventsResponse_Heartbeat) isWebhookEventsResponse_Payload() {}
+
+func (*WebhookEventsResponse_Notice) isWebhookEventsResponse_Payload() {}
+
+type WebhookEventBatch struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	EventId       string                 `protobuf:"bytes,1,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
-	Body          []byte                 `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
-	Headers       []*Header              `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
+	WebhookEvents []*WebhookEvent        `protobuf:"bytes,1,rep,name=webhook_events,json=webhookEvents,proto3" json:"webhook_events,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
+func (x *WebhookEventBatch) Reset() {
+	*x = WebhookEventBatch{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WebhookEventBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WebhookEventBatch) ProtoMessage() {}
+
+func (x *WebhookEventBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WebhookEventBatch.ProtoReflect.Descriptor instead.
+func (*WebhookEventBatch) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *WebhookEventBatch) GetWebhookEvents() []*WebhookEvent {
+	if x != nil {
+		return x.WebhookEvents
+	}
+	return nil
+}
+
+// sent when a stream had no events for a while, telling the client the server and connection are alive
+type Heartbeat struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	SentAtUnixMillis int64                  `protobuf:"varint,1,opt,name=sent_at_unix_millis,json=sentAtUnixMillis,proto3" json:"sent_at_unix_millis,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Heartbeat) Reset() {
+	*x = Heartbeat{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Heartbeat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Heartbeat) ProtoMessage() {}
+
+func (x *Heartbeat) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Heartbeat.ProtoReflect.Descriptor instead.
+func (*Heartbeat) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Heartbeat) GetSentAtUnixMillis() int64 {
+	if x != nil {
+		return x.SentAtUnixMillis
+	}
+	return 0
+}
+
+// tells the client about the server rather than about events, the stream ends after a draining notice
+type ServerNotice struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Kind          NoticeKind             `protobuf:"varint,1,opt,name=kind,proto3,enum=gitstafette.v1.NoticeKind" json:"kind,omitempty"`
+	Description   string                 `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerNotice) Reset() {
+	*x = ServerNotice{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerNotice) ProtoMessage() {}
+
+func (x *ServerNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerNotice.ProtoReflect.Descriptor instead.
+func (*ServerNotice) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ServerNotice) GetKind() NoticeKind {
+	if x != nil {
+		return x.Kind
+	}
+	return NoticeKind_NOTICE_KIND_UNSPECIFIED
+}
+
+func (x *ServerNotice) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+type WebhookEvent struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	EventId string                 `protobuf:"bytes,1,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	Body    []byte                 `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Headers []*Header              `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
+	// set when the body is encrypted for the receiving client
+	Encryption *PayloadEncryption `protobuf:"bytes,4,opt,name=encryption,proto3" json:"encryption,omitempty"`
+	// the position of the event in the events of its repository, used as the cursor to resume from
+	Sequence uint64 `protobuf:"varint,5,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// the ID of the repository the event is for, telling them apart when fetching with a pattern
+	RepositoryId string `protobuf:"bytes,6,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
+	// the full name of the repository, once the server learned it from a verified webhook
+	RepositoryName string `protobuf:"bytes,7,opt,name=repository_name,json=repositoryName,proto3" json:"repository_name,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
 func (x *WebhookEvent) Reset() {
 	*x = WebhookEvent{}
-	mi := &file_api_v1_gitstafette_proto_msgTypes[7]
+	mi := &file_api_v1_gitstafette_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -440,7 +741,7 @@ func (x *WebhookEvent) String() string {
 func (*WebhookEvent) ProtoMessage() {}
 
 func (x *WebhookEvent) ProtoReflect() protoreflect.Message {
-	mi := &file_api_v1_gitstafette_proto_msgTypes[7]
+	mi := &file_api_v1_gitstafette_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -453,7 +754,7 @@ func (x *WebhookEvent) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use WebhookEvent.ProtoReflect.Descriptor instead.
 func (*WebhookEvent) Descriptor() ([]byte, []int) {
-	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{7}
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *WebhookEvent) GetEventId() string {
@@ -477,17 +778,436 @@ func (x *WebhookEvent) GetHeaders() []*Header {
 	return nil
 }
 
+func (x *WebhookEvent) GetEncryption() *PayloadEncryption {
+	if x != nil {
+		return x.Encryption
+	}
+	return nil
+}
+
+func (x *WebhookEvent) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *WebhookEvent) GetRepositoryId() string {
+	if x != nil {
+		return x.RepositoryId
+	}
+	return ""
+}
+
+func (x *WebhookEvent) GetRepositoryName() string {
+	if x != nil {
+		return x.RepositoryName
+	}
+	return ""
+}
+
+type PayloadEncryption struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Algorithm          string                 `protobuf:"bytes,1,opt,name=algorithm,proto3" json:"algorithm,omitempty"`
+	KeyId              string                 `protobuf:"bytes,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	EphemeralPublicKey []byte                 `protobuf:"bytes,3,opt,name=ephemeral_public_key,json=ephemeralPublicKey,proto3" json:"ephemeral_public_key,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *PayloadEncryption) Reset() {
+	*x = PayloadEncryption{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PayloadEncryption) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PayloadEncryption) ProtoMessage() {}
+
+func (x *PayloadEncryption) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PayloadEncryption.ProtoReflect.Descriptor instead.
+func (*PayloadEncryption) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *PayloadEncryption) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *PayloadEncryption) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *PayloadEncryption) GetEphemeralPublicKey() []byte {
+	if x != nil {
+		return x.EphemeralPublicKey
+	}
+	return nil
+}
+
+type RegisterClientKeyRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	ClientId     string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	RepositoryId string                 `protobuf:"bytes,2,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
+	// raw X25519 public key, event bodies for the repository are encrypted with it
+	PublicKey     []byte `protobuf:"bytes,3,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterClientKeyRequest) Reset() {
+	*x = RegisterClientKeyRequest{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterClientKeyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterClientKeyRequest) ProtoMessage() {}
+
+func (x *RegisterClientKeyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterClientKeyRequest.ProtoReflect.Descriptor instead.
+func (*RegisterClientKeyRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *RegisterClientKeyRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *RegisterClientKeyRequest) GetRepositoryId() string {
+	if x != nil {
+		return x.RepositoryId
+	}
+	return ""
+}
+
+func (x *RegisterClientKeyRequest) GetPublicKey() []byte {
+	if x != nil {
+		return x.PublicKey
+	}
+	return nil
+}
+
+type RegisterClientKeyResponse struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	Accepted            bool                   `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	KeyId               string                 `protobuf:"bytes,2,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	ResponseDescription string                 `protobuf:"bytes,3,opt,name=response_description,json=responseDescription,proto3" json:"response_description,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *RegisterClientKeyResponse) Reset() {
+	*x = RegisterClientKeyResponse{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterClientKeyResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterClientKeyResponse) ProtoMessage() {}
+
+func (x *RegisterClientKeyResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterClientKeyResponse.ProtoReflect.Descriptor instead.
+func (*RegisterClientKeyResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *RegisterClientKeyResponse) GetAccepted() bool {
+	if x != nil {
+		return x.Accepted
+	}
+	return false
+}
+
+func (x *RegisterClientKeyResponse) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *RegisterClientKeyResponse) GetResponseDescription() string {
+	if x != nil {
+		return x.ResponseDescription
+	}
+	return ""
+}
+
+// a client declares the repository it serves, the server watches it until no client connected for it for a while
+type RegisterRepositoryRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	RepositoryId  string                 `protobuf:"bytes,2,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterRepositoryRequest) Reset() {
+	*x = RegisterRepositoryRequest{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRepositoryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRepositoryRequest) ProtoMessage() {}
+
+func (x *RegisterRepositoryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRepositoryRequest.ProtoReflect.Descriptor instead.
+func (*RegisterRepositoryRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *RegisterRepositoryRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *RegisterRepositoryRequest) GetRepositoryId() string {
+	if x != nil {
+		return x.RepositoryId
+	}
+	return ""
+}
+
+type RegisterRepositoryResponse struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	Accepted            bool                   `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	ResponseDescription string                 `protobuf:"bytes,2,opt,name=response_description,json=responseDescription,proto3" json:"response_description,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *RegisterRepositoryResponse) Reset() {
+	*x = RegisterRepositoryResponse{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRepositoryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRepositoryResponse) ProtoMessage() {}
+
+func (x *RegisterRepositoryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRepositoryResponse.ProtoReflect.Descriptor instead.
+func (*RegisterRepositoryResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *RegisterRepositoryResponse) GetAccepted() bool {
+	if x != nil {
+		return x.Accepted
+	}
+	return false
+}
+
+func (x *RegisterRepositoryResponse) GetResponseDescription() string {
+	if x != nil {
+		return x.ResponseDescription
+	}
+	return ""
+}
+
+// a client that fetches with acknowledge_events tells which events of a repository it stored, so they are relayed
+type AcknowledgeWebhookEventsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ClientId      string                 `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	RepositoryId  string                 `protobuf:"bytes,2,opt,name=repository_id,json=repositoryId,proto3" json:"repository_id,omitempty"`
+	EventIds      []string               `protobuf:"bytes,3,rep,name=event_ids,json=eventIds,proto3" json:"event_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AcknowledgeWebhookEventsRequest) Reset() {
+	*x = AcknowledgeWebhookEventsRequest{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AcknowledgeWebhookEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcknowledgeWebhookEventsRequest) ProtoMessage() {}
+
+func (x *AcknowledgeWebhookEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcknowledgeWebhookEventsRequest.ProtoReflect.Descriptor instead.
+func (*AcknowledgeWebhookEventsRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *AcknowledgeWebhookEventsRequest) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *AcknowledgeWebhookEventsRequest) GetRepositoryId() string {
+	if x != nil {
+		return x.RepositoryId
+	}
+	return ""
+}
+
+func (x *AcknowledgeWebhookEventsRequest) GetEventIds() []string {
+	if x != nil {
+		return x.EventIds
+	}
+	return nil
+}
+
+type AcknowledgeWebhookEventsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Acknowledged  uint32                 `protobuf:"varint,1,opt,name=acknowledged,proto3" json:"acknowledged,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AcknowledgeWebhookEventsResponse) Reset() {
+	*x = AcknowledgeWebhookEventsResponse{}
+	mi := &file_api_v1_gitstafette_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AcknowledgeWebhookEventsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcknowledgeWebhookEventsResponse) ProtoMessage() {}
+
+func (x *AcknowledgeWebhookEventsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_gitstafette_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcknowledgeWebhookEventsResponse.ProtoReflect.Descriptor instead.
+func (*AcknowledgeWebhookEventsResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *AcknowledgeWebhookEventsResponse) GetAcknowledged() uint32 {
+	if x != nil {
+		return x.Acknowledged
+	}
+	return 0
+}
+
 type Header struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Values        string                 `protobuf:"bytes,2,opt,name=values,proto3" json:"values,omitempty"`
+	Values        []string               `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Header) Reset() {
 	*x = Header{}
-	mi := &file_api_v1_gitstafette_proto_msgTypes[8]
+	mi := &file_api_v1_gitstafette_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -499,7 +1219,7 @@ func (x *Header) String() string {
 func (*Header) ProtoMessage() {}
 
 func (x *Header) ProtoReflect() protoreflect.Message {
-	mi := &file_api_v1_gitstafette_proto_msgTypes[8]
+	mi := &file_api_v1_gitstafette_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -512,7 +1232,7 @@ func (x *Header) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Header.ProtoReflect.Descriptor instead.
 func (*Header) Descriptor() ([]byte, []int) {
-	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{8}
+	return file_api_v1_gitstafette_proto_rawDescGZIP(), []int{18}
 }
 
 func (x *Header) GetName() string {
@@ -522,11 +1242,11 @@ func (x *Header) GetName() string {
 	return ""
 }
 
-func (x *Header) GetValues() string {
+func (x *Header) GetValues() []string {
 	if x != nil {
 		return x.Values
 	}
-	return ""
+	return nil
 }
 
 var File_api_v1_gitstafette_proto protoreflect.FileDescriptor
@@ -543,12 +1263,19 @@ const file_api_v1_gitstafette_proto_rawDesc = "" +
 	"\tserver_id\x18\x01 \x01(\tR\bserverId\x12\x14\n" +
 	"\x05count\x18\x02 \x01(\rR\x05count\x12#\n" +
 	"\rrepository_id\x18\x03 \x01(\tR\frepositoryId\x12\x16\n" +
-	"\x06status\x18\x04 \x01(\tR\x06status\"\xb2\x01\n" +
+	"\x06status\x18\x04 \x01(\tR\x06status\"\xba\x03\n" +
 	"\x14WebhookEventsRequest\x12\x1b\n" +
 	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12#\n" +
 	"\rrepository_id\x18\x02 \x01(\tR\frepositoryId\x123\n" +
 	"\x16last_received_event_id\x18\x03 \x01(\x04R\x13lastReceivedEventId\x12#\n" +
-	"\rduration_secs\x18\x04 \x01(\rR\fdurationSecs\"\x8e\x01\n" +
+	"\rduration_secs\x18\x04 \x01(\rR\fdurationSecs\x12%\n" +
+	"\x0erepository_ids\x18\x05 \x03(\tR\rrepositoryIds\x12'\n" +
+	"\x0ftyped_responses\x18\x06 \x01(\bR\x0etypedResponses\x12K\n" +
+	"\acursors\x18\a \x03(\v21.gitstafette.v1.WebhookEventsRequest.CursorsEntryR\acursors\x12-\n" +
+	"\x12acknowledge_events\x18\b \x01(\bR\x11acknowledgeEvents\x1a:\n" +
+	"\fCursorsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"\x8e\x01\n" +
 	"\x18WebhookEventPushResponse\x12#\n" +
 	"\rresponse_code\x18\x01 \x01(\tR\fresponseCode\x121\n" +
 	"\x14response_description\x18\x02 \x01(\tR\x13responseDescription\x12\x1a\n" +
@@ -556,21 +1283,70 @@ const file_api_v1_gitstafette_proto_rawDesc = "" +
 	"\x17WebhookEventPushRequest\x12\x1b\n" +
 	"\tcliend_id\x18\x01 \x01(\tR\bcliendId\x12#\n" +
 	"\rrepository_id\x18\x02 \x01(\tR\frepositoryId\x12A\n" +
-	"\rwebhook_event\x18\x03 \x01(\v2\x1c.gitstafette.v1.WebhookEventR\fwebhookEvent\"\\\n" +
+	"\rwebhook_event\x18\x03 \x01(\v2\x1c.gitstafette.v1.WebhookEventR\fwebhookEvent\"\x97\x02\n" +
 	"\x15WebhookEventsResponse\x12C\n" +
-	"\x0ewebhook_events\x18\x01 \x03(\v2\x1c.gitstafette.v1.WebhookEventR\rwebhookEvents\"o\n" +
+	"\x0ewebhook_events\x18\x01 \x03(\v2\x1c.gitstafette.v1.WebhookEventR\rwebhookEvents\x12;\n" +
+	"\x06events\x18\x02 \x01(\v2!.gitstafette.v1.WebhookEventBatchH\x00R\x06events\x129\n" +
+	"\theartbeat\x18\x03 \x01(\v2\x19.gitstafette.v1.HeartbeatH\x00R\theartbeat\x126\n" +
+	"\x06notice\x18\x04 \x01(\v2\x1c.gitstafette.v1.ServerNoticeH\x00R\x06noticeB\t\n" +
+	"\apayload\"X\n" +
+	"\x11WebhookEventBatch\x12C\n" +
+	"\x0ewebhook_events\x18\x01 \x03(\v2\x1c.gitstafette.v1.WebhookEventR\rwebhookEvents\":\n" +
+	"\tHeartbeat\x12-\n" +
+	"\x13sent_at_unix_millis\x18\x01 \x01(\x03R\x10sentAtUnixMillis\"`\n" +
+	"\fServerNotice\x12.\n" +
+	"\x04kind\x18\x01 \x01(\x0e2\x1a.gitstafette.v1.NoticeKindR\x04kind\x12 \n" +
+	"\vdescription\x18\x02 \x01(\tR\vdescription\"\x9c\x02\n" +
 	"\fWebhookEvent\x12\x19\n" +
 	"\bevent_id\x18\x01 \x01(\tR\aeventId\x12\x12\n" +
 	"\x04body\x18\x02 \x01(\fR\x04body\x120\n" +
-	"\aheaders\x18\x03 \x03(\v2\x16.gitstafette.v1.HeaderR\aheaders\"4\n" +
+	"\aheaders\x18\x03 \x03(\v2\x16.gitstafette.v1.HeaderR\aheaders\x12A\n" +
+	"\n" +
+	"encryption\x18\x04 \x01(\v2!.gitstafette.v1.PayloadEncryptionR\n" +
+	"encryption\x12\x1a\n" +
+	"\bsequence\x18\x05 \x01(\x04R\bsequence\x12#\n" +
+	"\rrepository_id\x18\x06 \x01(\tR\frepositoryId\x12'\n" +
+	"\x0frepository_name\x18\a \x01(\tR\x0erepositoryName\"z\n" +
+	"\x11PayloadEncryption\x12\x1c\n" +
+	"\talgorithm\x18\x01 \x01(\tR\talgorithm\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\tR\x05keyId\x120\n" +
+	"\x14ephemeral_public_key\x18\x03 \x01(\fR\x12ephemeralPublicKey\"{\n" +
+	"\x18RegisterClientKeyRequest\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12#\n" +
+	"\rrepository_id\x18\x02 \x01(\tR\frepositoryId\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x03 \x01(\fR\tpublicKey\"\x81\x01\n" +
+	"\x19RegisterClientKeyResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\bR\baccepted\x12\x15\n" +
+	"\x06key_id\x18\x02 \x01(\tR\x05keyId\x121\n" +
+	"\x14response_description\x18\x03 \x01(\tR\x13responseDescription\"]\n" +
+	"\x19RegisterRepositoryRequest\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12#\n" +
+	"\rrepository_id\x18\x02 \x01(\tR\frepositoryId\"k\n" +
+	"\x1aRegisterRepositoryResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\bR\baccepted\x121\n" +
+	"\x14response_description\x18\x02 \x01(\tR\x13responseDescription\"\x80\x01\n" +
+	"\x1fAcknowledgeWebhookEventsRequest\x12\x1b\n" +
+	"\tclient_id\x18\x01 \x01(\tR\bclientId\x12#\n" +
+	"\rrepository_id\x18\x02 \x01(\tR\frepositoryId\x12\x1b\n" +
+	"\tevent_ids\x18\x03 \x03(\tR\beventIds\"F\n" +
+	" AcknowledgeWebhookEventsResponse\x12\"\n" +
+	"\facknowledged\x18\x01 \x01(\rR\facknowledged\"4\n" +
 	"\x06Header\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x16\n" +
-	"\x06values\x18\x02 \x01(\tR\x06values2\xc1\x03\n" +
+	"\x06values\x18\x02 \x03(\tR\x06values*C\n" +
+	"\n" +
+	"NoticeKind\x12\x1b\n" +
+	"\x17NOTICE_KIND_UNSPECIFIED\x10\x00\x12\x18\n" +
+	"\x14NOTICE_KIND_DRAINING\x10\x012\x9d\x06\n" +
 	"\vGitstafette\x12e\n" +
 	"\x12FetchWebhookEvents\x12$.gitstafette.v1.WebhookEventsRequest\x1a%.gitstafette.v1.WebhookEventsResponse\"\x000\x01\x12g\n" +
 	"\x10WebhookEventPush\x12'.gitstafette.v1.WebhookEventPushRequest\x1a(.gitstafette.v1.WebhookEventPushResponse\"\x00\x12m\n" +
 	"\x12WebhookEventStatus\x12).gitstafette.v1.WebhookEventStatusRequest\x1a*.gitstafette.v1.WebhookEventStatusResponse\"\x00\x12s\n" +
-	"\x14WebhookEventStatuses\x12+.gitstafette.v1.WebhookEventStatusesRequest\x1a*.gitstafette.v1.WebhookEventStatusResponse\"\x000\x01B4Z2github.com/joostvdg/gitstafette/api/gitstafette_v1b\x06proto3"
+	"\x14WebhookEventStatuses\x12+.gitstafette.v1.WebhookEventStatusesRequest\x1a*.gitstafette.v1.WebhookEventStatusResponse\"\x000\x01\x12j\n" +
+	"\x11RegisterClientKey\x12(.gitstafette.v1.RegisterClientKeyRequest\x1a).gitstafette.v1.RegisterClientKeyResponse\"\x00\x12m\n" +
+	"\x12RegisterRepository\x12).gitstafette.v1.RegisterRepositoryRequest\x1a*.gitstafette.v1.RegisterRepositoryResponse\"\x00\x12\x7f\n" +
+	"\x18AcknowledgeWebhookEvents\x12/.gitstafette.v1.AcknowledgeWebhookEventsRequest\x1a0.gitstafette.v1.AcknowledgeWebhookEventsResponse\"\x00B4Z2github.com/joostvdg/gitstafette/api/gitstafette_v1b\x06proto3"
 
 var (
 	file_api_v1_gitstafette_proto_rawDescOnce sync.Once
@@ -584,35 +1360,61 @@ func file_api_v1_gitstafette_proto_rawDescGZIP() []byte {
 	return file_api_v1_gitstafette_proto_rawDescData
 }
 
-var file_api_v1_gitstafette_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_api_v1_gitstafette_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_v1_gitstafette_proto_msgTypes = make([]protoimpl.MessageInfo, 20)
 var file_api_v1_gitstafette_proto_goTypes = []any{
-	(*WebhookEventStatusRequest)(nil),   // 0: gitstafette.v1.WebhookEventStatusRequest
-	(*WebhookEventStatusesRequest)(nil), // 1: gitstafette.v1.WebhookEventStatusesRequest
-	(*WebhookEventStatusResponse)(nil),  // 2: gitstafette.v1.WebhookEventStatusResponse
-	(*WebhookEventsRequest)(nil),        // 3: gitstafette.v1.WebhookEventsRequest
-	(*WebhookEventPushResponse)(nil),    // 4: gitstafette.v1.WebhookEventPushResponse
-	(*WebhookEventPushRequest)(nil),     // 5: gitstafette.v1.WebhookEventPushRequest
-	(*WebhookEventsResponse)(nil),       // 6: gitstafette.v1.WebhookEventsResponse
-	(*WebhookEvent)(nil),                // 7: gitstafette.v1.WebhookEvent
-	(*Header)(nil),                      // 8: gitstafette.v1.Header
+	(NoticeKind)(0),                          // 0: gitstafette.v1.NoticeKind
+	(*WebhookEventStatusRequest)(nil),        // 1: gitstafette.v1.WebhookEventStatusRequest
+	(*WebhookEventStatusesRequest)(nil),      // 2: gitstafette.v1.WebhookEventStatusesRequest
+	(*WebhookEventStatusResponse)(nil),       // 3: gitstafette.v1.WebhookEventStatusResponse
+	(*WebhookEventsRequest)(nil),             // 4: gitstafette.v1.WebhookEventsRequest
+	(*WebhookEventPushResponse)(nil),         // 5: gitstafette.v1.WebhookEventPushResponse
+	(*WebhookEventPushRequest)(nil),          // 6: gitstafette.v1.WebhookEventPushRequest
+	(*WebhookEventsResponse)(nil),            // 7: gitstafette.v1.WebhookEventsResponse
+	(*WebhookEventBatch)(nil),                // 8: gitstafette.v1.WebhookEventBatch
+	(*Heartbeat)(nil),                        // 9: gitstafette.v1.Heartbeat
+	(*ServerNotice)(nil),                     // 10: gitstafette.v1.ServerNotice
+	(*WebhookEvent)(nil),                     // 11: gitstafette.v1.WebhookEvent
+	(*PayloadEncryption)(nil),                // 12: gitstafette.v1.PayloadEncryption
+	(*RegisterClientKeyRequest)(nil),         // 13: gitstafette.v1.RegisterClientKeyRequest
+	(*RegisterClientKeyResponse)(nil),        // 14: gitstafette.v1.RegisterClientKeyResponse
+	(*RegisterRepositoryRequest)(nil),        // 15: gitstafette.v1.RegisterRepositoryRequest
+	(*RegisterRepositoryResponse)(nil),       // 16: gitstafette.v1.RegisterRepositoryResponse
+	(*AcknowledgeWebhookEventsRequest)(nil),  // 17: gitstafette.v1.AcknowledgeWebhookEventsRequest
+	(*AcknowledgeWebhookEventsResponse)(nil), // 18: gitstafette.v1.AcknowledgeWebhookEventsResponse
+	(*Header)(nil),                           // 19: gitstafette.v1.Header
+	nil,                                      // 20: gitstafette.v1.WebhookEventsRequest.CursorsEntry
 }
 var file_api_v1_gitstafette_proto_depIdxs = []int32{
-	7, // 0: gitstafette.v1.WebhookEventPushRequest.webhook_event:type_name -> gitstafette.v1.WebhookEvent
-	7, // 1: gitstafette.v1.WebhookEventsResponse.webhook_events:type_name -> gitstafette.v1.WebhookEvent
-	8, // 2: gitstafette.v1.WebhookEvent.headers:type_name -> gitstafette.v1.Header
-	3, // 3: gitstafette.v1.Gitstafette.FetchWebhookEvents:input_type -> gitstafette.v1.WebhookEventsRequest
-	5, // 4: gitstafette.v1.Gitstafette.WebhookEventPush:input_type -> gitstafette.v1.WebhookEventPushRequest
-	0, // 5: gitstafette.v1.Gitstafette.WebhookEventStatus:input_type -> gitstafette.v1.WebhookEventStatusRequest
-	1, // 6: gitstafette.v1.Gitstafette.WebhookEventStatuses:input_type -> gitstafette.v1.WebhookEventStatusesRequest
-	6, // 7: gitstafette.v1.Gitstafette.FetchWebhookEvents:output_type -> gitstafette.v1.WebhookEventsResponse
-	4, // 8: gitstafette.v1.Gitstafette.WebhookEventPush:output_type -> gitstafette.v1.WebhookEventPushResponse
-	2, // 9: gitstafette.v1.Gitstafette.WebhookEventStatus:output_type -> gitstafette.v1.WebhookEventStatusResponse
-	2, // 10: gitstafette.v1.Gitstafette.WebhookEventStatuses:output_type -> gitstafette.v1.WebhookEventStatusResponse
-	7, // [7:11] is the sub-list for method output_type
-	3, // [3:7] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	20, // 0: gitstafette.v1.WebhookEventsRequest.cursors:type_name -> gitstafette.v1.WebhookEventsRequest.CursorsEntry
+	11, // 1: gitstafette.v1.WebhookEventPushRequest.webhook_event:type_name -> gitstafette.v1.WebhookEvent
+	11, // 2: gitstafette.v1.WebhookEventsResponse.webhook_events:type_name -> gitstafette.v1.WebhookEvent
+	8,  // 3: gitstafette.v1.WebhookEventsResponse.events:type_name -> gitstafette.v1.WebhookEventBatch
+	9,  // 4: gitstafette.v1.WebhookEventsResponse.heartbeat:type_name -> gitstafette.v1.Heartbeat
+	10, // 5: gitstafette.v1.WebhookEventsResponse.notice:type_name -> gitstafette.v1.ServerNotice
+	11, // 6: gitstafette.v1.WebhookEventBatch.webhook_events:type_name -> gitstafette.v1.WebhookEvent
+	0,  // 7: gitstafette.v1.ServerNotice.kind:type_name -> gitstafette.v1.NoticeKind
+	19, // 8: gitstafette.v1.WebhookEvent.headers:type_name -> gitstafette.v1.Header
+	12, // 9: gitstafette.v1.WebhookEvent.encryption:type_name -> gitstafette.v1.PayloadEncryption
+	4,  // 10: gitstafette.v1.Gitstafette.FetchWebhookEvents:input_type -> gitstafette.v1.WebhookEventsRequest
+	6,  // 11: gitstafette.v1.Gitstafette.WebhookEventPush:input_type -> gitstafette.v1.WebhookEventPushRequest
+	1,  // 12: gitstafette.v1.Gitstafette.WebhookEventStatus:input_type -> gitstafette.v1.WebhookEventStatusRequest
+	2,  // 13: gitstafette.v1.Gitstafette.WebhookEventStatuses:input_type -> gitstafette.v1.WebhookEventStatusesRequest
+	13, // 14: gitstafette.v1.Gitstafette.RegisterClientKey:input_type -> gitstafette.v1.RegisterClientKeyRequest
+	15, // 15: gitstafette.v1.Gitstafette.RegisterRepository:input_type -> gitstafette.v1.RegisterRepositoryRequest
+	17, // 16: gitstafette.v1.Gitstafette.AcknowledgeWebhookEvents:input_type -> gitstafette.v1.AcknowledgeWebhookEventsRequest
+	7,  // 17: gitstafette.v1.Gitstafette.FetchWebhookEvents:output_type -> gitstafette.v1.WebhookEventsResponse
+	5,  // 18: gitstafette.v1.Gitstafette.WebhookEventPush:output_type -> gitstafette.v1.WebhookEventPushResponse
+	3,  // 19: gitstafette.v1.Gitstafette.WebhookEventStatus:output_type -> gitstafette.v1.WebhookEventStatusResponse
+	3,  // 20: gitstafette.v1.Gitstafette.WebhookEventStatuses:output_type -> gitstafette.v1.WebhookEventStatusResponse
+	14, // 21: gitstafette.v1.Gitstafette.RegisterClientKey:output_type -> gitstafette.v1.RegisterClientKeyResponse
+	16, // 22: gitstafette.v1.Gitstafette.RegisterRepository:output_type -> gitstafette.v1.RegisterRepositoryResponse
+	18, // 23: gitstafette.v1.Gitstafette.AcknowledgeWebhookEvents:output_type -> gitstafette.v1.AcknowledgeWebhookEventsResponse
+	17, // [17:24] is the sub-list for method output_type
+	10, // [10:17] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_api_v1_gitstafette_proto_init() }
@@ -620,18 +1422,24 @@ func file_api_v1_gitstafette_proto_init() {
 	if File_api_v1_gitstafette_proto != nil {
 		return
 	}
+	file_api_v1_gitstafette_proto_msgTypes[6].OneofWrappers = []any{
+		(*WebhookEventsResponse_Events)(nil),
+		(*WebhookEventsResponse_Heartbeat)(nil),
+		(*WebhookEventsResponse_Notice)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_v1_gitstafette_proto_rawDesc), len(file_api_v1_gitstafette_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   9,
+			NumEnums:      1,
+			NumMessages:   20,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_api_v1_gitstafette_proto_goTypes,
 		DependencyIndexes: file_api_v1_gitstafette_proto_depIdxs,
+		EnumInfos:         file_api_v1_gitstafette_proto_enumTypes,
 		MessageInfos:      file_api_v1_gitstafette_proto_msgTypes,
 	}.Build()
 	File_api_v1_gitstafette_proto = out.File
@@ -21,6 +21,9 @@ type GitstafetteClient interface {
 	WebhookEventPush(ctx context.Context, in *WebhookEventPushRequest, opts ...grpc.CallOption) (*WebhookEventPushResponse, error)
 	WebhookEventStatus(ctx context.Context, in *WebhookEventStatusRequest, opts ...grpc.CallOption) (*WebhookEventStatusResponse, error)
 	WebhookEventStatuses(ctx context.Context, in *WebhookEventStatusesRequest, opts ...grpc.CallOption) (Gitstafette_WebhookEventStatusesClient, error)
+	RegisterClientKey(ctx context.Context, in *RegisterClientKeyRequest, opts ...grpc.CallOption) (*RegisterClientKeyResponse, error)
+	RegisterRepository(ctx context.Context, in *RegisterRepositoryRequest, opts ...grpc.CallOption) (*RegisterRepositoryResponse, error)
+	AcknowledgeWebhookEvents(ctx context.Context, in *AcknowledgeWebhookEventsRequest, opts ...grpc.CallOption) (*AcknowledgeWebhookEventsResponse, error)
 }
 
 type gitstafetteClient struct {
@@ -113,6 +116,33 @@ func (x *gitstafetteWebhookEventStatusesClient) Recv() (*WebhookEventStatusRespo
 	return m, nil
 }
 
+func (c *gitstafetteClient) RegisterClientKey(ctx context.Context, in *RegisterClientKeyRequest, opts ...grpc.CallOption) (*RegisterClientKeyResponse, error) {
+	out := new(RegisterClientKeyResponse)
+	err := c.cc.Invoke(ctx, "/gitstafette.v1.Gitstafette/RegisterClientKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gitstafetteClient) RegisterRepository(ctx context.Context, in *RegisterRepositoryRequest, opts ...grpc.CallOption) (*RegisterRepositoryResponse, error) {
+	out := new(RegisterRepositoryResponse)
+	err := c.cc.Invoke(ctx, "/gitstafette.v1.Gitstafette/RegisterRepository", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *gitstafetteClient) AcknowledgeWebhookEvents(ctx context.Context, in *AcknowledgeWebhookEventsRequest, opts ...grpc.CallOption) (*AcknowledgeWebhookEventsResponse, error) {
+	out := new(AcknowledgeWebhookEventsResponse)
+	err := c.cc.Invoke(ctx, "/gitstafette.v1.Gitstafette/AcknowledgeWebhookEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // GitstafetteServer is the server API for Gitstafette service.
 // All implementations must embed UnimplementedGitstafetteServer
 // for forward compatibility
@@ -121,6 +151,9 @@ type GitstafetteServer interface {
 	WebhookEventPush(context.Context, *WebhookEventPushRequest) (*WebhookEventPushResponse, error)
 	WebhookEventStatus(context.Context, *WebhookEventStatusRequest) (*WebhookEventStatusResponse, error)
 	WebhookEventStatuses(*WebhookEventStatusesRequest, Gitstafette_WebhookEventStatusesServer) error
+	RegisterClientKey(context.Context, *RegisterClientKeyRequest) (*RegisterClientKeyResponse, error)
+	RegisterRepository(context.Context, *RegisterRepositoryRequest) (*RegisterRepositoryResponse, error)
+	AcknowledgeWebhookEvents(context.Context, *AcknowledgeWebhookEventsRequest) (*AcknowledgeWebhookEventsResponse, error)
 	mustEmbedUnimplementedGitstafetteServer()
 }
 
@@ -140,6 +173,15 @@ func (UnimplementedGitstafetteServer) WebhookEventStatus(context.Context, *Webho
 func (UnimplementedGitstafetteServer) WebhookEventStatuses(*WebhookEventStatusesRequest, Gitstafette_WebhookEventStatusesServer) error {
 	return status.Errorf(codes.Unimplemented, "method WebhookEventStatuses not implemented")
 }
+func (UnimplementedGitstafetteServer) RegisterClientKey(context.Context, *RegisterClientKeyRequest) (*RegisterClientKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterClientKey not implemented")
+}
+func (UnimplementedGitstafetteServer) RegisterRepository(context.Context, *RegisterRepositoryRequest) (*RegisterRepositoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterRepository not implemented")
+}
+func (UnimplementedGitstafetteServer) AcknowledgeWebhookEvents(context.Context, *AcknowledgeWebhookEventsRequest) (*AcknowledgeWebhookEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AcknowledgeWebhookEvents not implemented")
+}
 func (UnimplementedGitstafetteServer) mustEmbedUnimplementedGitstafetteServer() {}
 
 // UnsafeGitstafetteServer may be embedded to opt out of forward compatibility for this service.
@@ -231,6 +273,60 @@ func (x *gitstafetteWebhookEventStatusesServer) Send(m *WebhookEventStatusRespon
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Gitstafette_RegisterClientKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterClientKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GitstafetteServer).RegisterClientKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gitstafette.v1.Gitstafette/RegisterClientKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GitstafetteServer).RegisterClientKey(ctx, req.(*RegisterClientKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gitstafette_RegisterRepository_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRepositoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GitstafetteServer).RegisterRepository(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gitstafette.v1.Gitstafette/RegisterRepository",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GitstafetteServer).RegisterRepository(ctx, req.(*RegisterRepositoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Gitstafette_AcknowledgeWebhookEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AcknowledgeWebhookEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GitstafetteServer).AcknowledgeWebhookEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gitstafette.v1.Gitstafette/AcknowledgeWebhookEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GitstafetteServer).AcknowledgeWebhookEvents(ctx, req.(*AcknowledgeWebhookEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Gitstafette_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "gitstafette.v1.Gitstafette",
 	HandlerType: (*GitstafetteServer)(nil),
@@ -243,6 +339,18 @@ var _Gitstafette_serviceDesc = grpc.ServiceDesc{
 			MethodName: "WebhookEventStatus",
 			Handler:    _Gitstafette_WebhookEventStatus_Handler,
 		},
+		{
+			MethodName: "RegisterClientKey",
+			Handler:    _Gitstafette_RegisterClientKey_Handler,
+		},
+		{
+			MethodName: "RegisterRepository",
+			Handler:    _Gitstafette_RegisterRepository_Handler,
+		},
+		{
+			MethodName: "AcknowledgeWebhookEvents",
+			Handler:    _Gitstafette_AcknowledgeWebhookEvents_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
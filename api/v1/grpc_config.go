@@ -1,27 +1,32 @@
 package gitstafette_v1
 
 import (
+	"crypto/ecdh"
 	"crypto/tls"
 	"github.com/rs/zerolog/log"
 )
 
 type GRPCServerConfig struct {
-	Host         string
-	Port         string
-	StreamWindow int
-	Insecure     bool
-	OAuthToken   string
-	TLSConfig    *tls.Config
+	Host           string
+	Port           string
+	StreamWindow   int
+	Insecure       bool
+	OAuthToken     string
+	TLSConfig      *tls.Config
+	Compression    string // compressor used for messages sent to the server, empty for none
+	MaxMessageSize int    // in bytes, the largest message accepted from the server
 }
 
-func CreateServerConfig(host string, port string, streamWindow int, insecure bool, oauthToken string, tlsConfig *tls.Config) *GRPCServerConfig {
+func CreateServerConfig(host string, port string, streamWindow int, insecure bool, oauthToken string, tlsConfig *tls.Config, compression string, maxMessageSize int) *GRPCServerConfig {
 	config := &GRPCServerConfig{
-		Host:         host,
-		Port:         port,
-		StreamWindow: streamWindow,
-		Insecure:     insecure,
-		OAuthToken:   oauthToken,
-		TLSConfig:    tlsConfig,
+		Host:           host,
+		Port:           port,
+		StreamWindow:   streamWindow,
+		Insecure:       insecure,
+		OAuthToken:     oauthToken,
+		TLSConfig:      tlsConfig,
+		Compression:    compression,
+		MaxMessageSize: maxMessageSize,
 	}
 
 	log.Info().Msgf("Constructed GRPC Server configuration: %v", *config)
@@ -29,18 +34,27 @@ func CreateServerConfig(host string, port string, streamWindow int, insecure boo
 }
 
 type GRPCClientConfig struct {
-	ClientID     string
-	RepositoryId string
-	StreamWindow int
-	WebhookHMAC  string
+	ClientID      string
+	RepositoryIds []string // fetched on one stream, each an ID, full name, or pattern
+	StreamWindow  int
+	WebhookHMAC   string
+	EndToEndKey   *ecdh.PrivateKey // when set, the server is asked to encrypt event bodies for this key
+	// RegisterRepository asks the server to watch the repositories, for servers not configured with it
+	RegisterRepository bool
+	// AcknowledgeEvents tells the server which events we stored, rather than it taking every event sent as relayed
+	AcknowledgeEvents bool
 }
 
-func CreateClientConfig(clientId string, repositoryId string, streamWindow int, webhookHMAC string) *GRPCClientConfig {
+func CreateClientConfig(clientId string, repositoryIds []string, streamWindow int, webhookHMAC string, endToEndKey *ecdh.PrivateKey, registerRepository bool, acknowledgeEvents bool) *GRPCClientConfig {
 	config := &GRPCClientConfig{
-		ClientID:     clientId,
-		RepositoryId: repositoryId,
-		StreamWindow: streamWindow,
-		WebhookHMAC:  webhookHMAC,
+		ClientID:      clientId,
+		RepositoryIds: repositoryIds,
+		StreamWindow:  streamWindow,
+		WebhookHMAC:   webhookHMAC,
+		EndToEndKey:   endToEndKey,
+
+		RegisterRepository: registerRepository,
+		AcknowledgeEvents:  acknowledgeEvents,
 	}
 	log.Info().Msgf("Constructed GRPC Client configuration: %v", *config)
 	return config
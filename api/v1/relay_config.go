@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"net/url"
+	"strings"
+	"time"
 )
 
 type ServerConfig struct {
@@ -12,6 +14,10 @@ type ServerConfig struct {
 	Port         string
 	GrpcPort     string
 	Repositories []string
+	// RepositoryRegistration allows clients to register the repositories they serve
+	RepositoryRegistration bool
+	// MaxStreamAge is how long a client stream lives before the client is asked to reconnect, zero is indefinitely
+	MaxStreamAge time.Duration
 }
 type RelayConfig struct {
 	Enabled        bool
@@ -22,9 +28,11 @@ type RelayConfig struct {
 	Endpoint       *url.URL
 	HealthEndpoint *url.URL
 	Insecure       bool
+	// Routes relay the events of a repository, by ID or full name, to their own endpoint on the relay host
+	Routes map[string]*url.URL
 }
 
-func CreateRelayConfig(relayEnabled bool, relayHost string, relayPath string, relayHealthCheckPath string, relayPort string, relayProtocol string, insecure bool) (*RelayConfig, error) {
+func CreateRelayConfig(relayEnabled bool, relayHost string, relayPath string, relayHealthCheckPath string, relayPort string, relayProtocol string, insecure bool, relayRoutes string) (*RelayConfig, error) {
 	relayEndpoint := fmt.Sprintf("%s://%s:%s%s", relayProtocol, relayHost, relayPort, relayPath)
 	relayEndpointURL, err := url.Parse(relayEndpoint)
 	if err != nil {
@@ -39,6 +47,22 @@ func CreateRelayConfig(relayEnabled bool, relayHost string, relayPath string, re
 		return nil, err
 	}
 
+	routes := make(map[string]*url.URL)
+	if relayRoutes != "" {
+		for _, route := range strings.Split(relayRoutes, ",") {
+			repository, path, found := strings.Cut(route, "=")
+			if !found || repository == "" {
+				return nil, fmt.Errorf("relay route %q is not of the form repository=path", route)
+			}
+			routeURL, err := url.Parse(fmt.Sprintf("%s://%s:%s%s", relayProtocol, relayHost, relayPort, path))
+			if err != nil {
+				return nil, err
+			}
+			routes[strings.ToLower(repository)] = routeURL
+			log.Info().Msgf("Configured relay endpoint URL for repository %v: %v\n", repository, routeURL.String())
+		}
+	}
+
 	// TODO remove debug statement
 	log.Info().Msgf("Configured relay endpoint URL: %v\n", relayEndpointURL.String())
 	log.Info().Msgf("Configured relay healthcheck endpoint URL: %v\n", heatlhCheckEndpointURL.String())
@@ -52,5 +76,16 @@ func CreateRelayConfig(relayEnabled bool, relayHost string, relayPath string, re
 		Endpoint:       relayEndpointURL,
 		HealthEndpoint: heatlhCheckEndpointURL,
 		Insecure:       insecure,
+		Routes:         routes,
 	}, nil
 }
+
+// EndpointFor returns the endpoint to relay the events of the repository to, given its ID and full name if known
+func (r *RelayConfig) EndpointFor(repositoryAliases ...string) *url.URL {
+	for _, repository := range repositoryAliases {
+		if endpoint, ok := r.Routes[strings.ToLower(repository)]; ok {
+			return endpoint
+		}
+	}
+	return r.Endpoint
+}
@@ -2,12 +2,39 @@ package gitstafette_v1
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 )
 
 const DeliveryIdHeader = "X-Github-Delivery"
 
+// PayloadRepositoryFullName returns the repository.full_name (owner/name) of a webhook payload, sent either as JSON
+// or as the form encoded payload field, or an empty string when the payload has none
+func PayloadRepositoryFullName(body []byte, contentType string) string {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		body = []byte(values.Get("payload"))
+	}
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.Repository.FullName
+}
+
 type WebhookEventInternal struct {
 	ID           string               `json:"id"`
 	IsRelayed    bool                 `json:"isRelayed"`
@@ -15,55 +42,176 @@ type WebhookEventInternal struct {
 	TimeReceived time.Time            `json:"receivedTime"`
 	Headers      []WebhookEventHeader `json:"headers"`
 	EventBody    string               `json:"eventBody"`
+	Payload      []byte               `json:"payload,omitempty"`     // the body as stored, when it is not kept as plain text
+	Compression  string               `json:"compression,omitempty"` // the compression applied to Payload, if any
+	// set when the body and headers are encrypted at rest, see SealedHeaders
+	KeyID         string `json:"keyId,omitempty"`
+	WrappedKey    []byte `json:"wrappedKey,omitempty"`
+	SealedHeaders []byte `json:"sealedHeaders,omitempty"`
+	// set when the body is encrypted for the receiving client, EventBody then holds the base64 encoded ciphertext
+	EndToEnd *EndToEndEncryption `json:"endToEnd,omitempty"`
+	// Sequence is assigned by the store, increasing per repository
+	Sequence uint64 `json:"sequence,omitempty"`
+	// RepositoryName is the full name of the repository as the server sent it, kept so the event can be routed by it
+	RepositoryName string `json:"repositoryName,omitempty"`
+}
+
+// EndToEndEncryption describes how an event body is encrypted for the receiving client
+type EndToEndEncryption struct {
+	Algorithm          string `json:"algorithm"`
+	KeyID              string `json:"keyId"`
+	EphemeralPublicKey []byte `json:"ephemeralPublicKey"`
 }
 
+// WebhookEventHeader holds every value received for a single (canonicalized) header name
 type WebhookEventHeader struct {
-	Key        string `json:"key"`
-	FirstValue string `json:"firstValue"`
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+// UnmarshalJSON also accepts headers cached before multiple values were supported
+func (h *WebhookEventHeader) UnmarshalJSON(data []byte) error {
+	var header struct {
+		Key        string   `json:"key"`
+		Values     []string `json:"values"`
+		FirstValue string   `json:"firstValue"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	h.Key = header.Key
+	h.Values = header.Values
+	if len(h.Values) == 0 && header.FirstValue != "" {
+		h.Values = []string{header.FirstValue}
+	}
+	return nil
+}
+
+// FirstValue returns the first value of the header, or an empty string if it has none
+func (h WebhookEventHeader) FirstValue() string {
+	if len(h.Values) == 0 {
+		return ""
+	}
+	return h.Values[0]
+}
+
+// HTTPHeadersToEventHeaders converts HTTP headers into event headers, sorted by name.
+// Header names are canonicalized and headers without a name or without values are dropped.
+func HTTPHeadersToEventHeaders(headers http.Header) []WebhookEventHeader {
+	canonical := make(http.Header, len(headers))
+	for key, values := range headers {
+		if key == "" || len(values) == 0 {
+			continue
+		}
+		canonicalKey := http.CanonicalHeaderKey(key)
+		canonical[canonicalKey] = append(canonical[canonicalKey], values...)
+	}
+
+	keys := make([]string, 0, len(canonical))
+	for key := range canonical {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	eventHeaders := make([]WebhookEventHeader, 0, len(keys))
+	for _, key := range keys {
+		values := make([]string, len(canonical[key]))
+		copy(values, canonical[key])
+		eventHeaders = append(eventHeaders, WebhookEventHeader{
+			Key:    key,
+			Values: values,
+		})
+	}
+	return eventHeaders
+}
+
+// EventHeadersToHTTPHeaders converts event headers back into HTTP headers, keeping all values
+func EventHeadersToHTTPHeaders(eventHeaders []WebhookEventHeader) http.Header {
+	headers := make(http.Header, len(eventHeaders))
+	for _, header := range eventHeaders {
+		if header.Key == "" || len(header.Values) == 0 {
+			continue
+		}
+		key := http.CanonicalHeaderKey(header.Key)
+		headers[key] = append(headers[key], header.Values...)
+	}
+	return headers
 }
 
 func ExternalToInternalEvent(event *WebhookEvent) *WebhookEventInternal {
-	webhookEventHeaders := make([]WebhookEventHeader, 0)
-	deliveryId := ""
+	headers := make(http.Header, len(event.Headers))
 	for _, header := range event.Headers {
-		key := header.Name
-		value := header.Values
-		if key != "" && value != "" {
-			webhookEventHeader := WebhookEventHeader{
-				Key:        key,
-				FirstValue: value,
-			}
-			if key == DeliveryIdHeader {
-				deliveryId = value
-			}
-			webhookEventHeaders = append(webhookEventHeaders, webhookEventHeader)
+		if header == nil {
+			continue
 		}
+		key := http.CanonicalHeaderKey(header.Name)
+		headers[key] = append(headers[key], header.Values...)
 	}
+	webhookEventHeaders := HTTPHeadersToEventHeaders(headers)
+	deliveryId := headers.Get(DeliveryIdHeader)
 
 	log.Printf("webhookEventHeaders: %v\n", webhookEventHeaders)
 	eventBody := bytes.NewBuffer(event.Body).String()
+	var endToEnd *EndToEndEncryption
+	if event.Encryption != nil {
+		eventBody = base64.StdEncoding.EncodeToString(event.Body)
+		endToEnd = &EndToEndEncryption{
+			Algorithm:          event.Encryption.Algorithm,
+			KeyID:              event.Encryption.KeyId,
+			EphemeralPublicKey: event.Encryption.EphemeralPublicKey,
+		}
+	}
 	return &WebhookEventInternal{
-		ID:           deliveryId,
-		IsRelayed:    false,
-		TimeReceived: time.Now(),
-		Headers:      webhookEventHeaders,
-		EventBody:    eventBody,
+		ID:             deliveryId,
+		IsRelayed:      false,
+		TimeReceived:   time.Now(),
+		Headers:        webhookEventHeaders,
+		EventBody:      eventBody,
+		EndToEnd:       endToEnd,
+		RepositoryName: event.RepositoryName,
 	}
 }
 
 func InternalToExternalEvent(internalEvent *WebhookEventInternal) *WebhookEvent {
-	headers := make([]*Header, len(internalEvent.Headers))
+	headers := make([]*Header, 0, len(internalEvent.Headers))
 	for _, header := range internalEvent.Headers {
-		header := &Header{
-			Name:   header.Key,
-			Values: header.FirstValue,
+		if header.Key == "" || len(header.Values) == 0 {
+			continue
 		}
-		headers = append(headers, header)
+		values := make([]string, len(header.Values))
+		copy(values, header.Values)
+		headers = append(headers, &Header{
+			Name:   http.CanonicalHeaderKey(header.Key),
+			Values: values,
+		})
+	}
+
+	event := &WebhookEvent{
+		EventId:  internalEvent.ID,
+		Body:     []byte(internalEvent.EventBody),
+		Headers:  headers,
+		Sequence: internalEvent.Sequence,
 	}
+	if internalEvent.EndToEnd != nil {
+		body, err := base64.StdEncoding.DecodeString(internalEvent.EventBody)
+		if err != nil {
+			log.Printf("Could not decode encrypted body of event %v: %v\n", internalEvent.ID, err)
+		}
+		event.Body = body
+		event.Encryption = &PayloadEncryption{
+			Algorithm:          internalEvent.EndToEnd.Algorithm,
+			KeyId:              internalEvent.EndToEnd.KeyID,
+			EphemeralPublicKey: internalEvent.EndToEnd.EphemeralPublicKey,
+		}
+	}
+	return event
+}
 
-	return &WebhookEvent{
-		EventId: internalEvent.ID,
-		Body:    []byte(internalEvent.EventBody),
-		Headers: headers,
+// ResponseEvents returns the events of a stream response, from its payload or, for servers that do not send
+// typed responses, from its webhook_events
+func ResponseEvents(response *WebhookEventsResponse) []*WebhookEvent {
+	if batch := response.GetEvents(); batch != nil {
+		return batch.GetWebhookEvents()
 	}
+	return response.GetWebhookEvents()
 }
@@ -0,0 +1,78 @@
+package gitstafette_v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHeadersRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    http.Header
+	}{
+		{
+			name:    "single values",
+			headers: http.Header{"X-Github-Event": {"push"}, "X-Github-Delivery": {"d1"}},
+			want:    http.Header{"X-Github-Event": {"push"}, "X-Github-Delivery": {"d1"}},
+		},
+		{
+			name:    "multiple values keep their order",
+			headers: http.Header{"Accept": {"text/plain", "application/json"}, "Set-Cookie": {"a=1", "b=2", "c=3"}},
+			want:    http.Header{"Accept": {"text/plain", "application/json"}, "Set-Cookie": {"a=1", "b=2", "c=3"}},
+		},
+		{
+			name:    "non canonical names are merged",
+			headers: http.Header{"x-hub-signature-256": {"sha256=1"}, "X-Hub-Signature-256": {"sha256=2"}},
+			want:    http.Header{"X-Hub-Signature-256": {"sha256=1", "sha256=2"}},
+		},
+		{
+			name:    "empty values are kept, headers without values dropped",
+			headers: http.Header{"X-Empty": {""}, "X-None": {}, "": {"nameless"}},
+			want:    http.Header{"X-Empty": {""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// as the webhook handler caches it
+			stored, err := json.Marshal(&WebhookEventInternal{ID: "d1", Headers: HTTPHeadersToEventHeaders(tt.headers)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached := new(WebhookEventInternal)
+			if err := json.Unmarshal(stored, cached); err != nil {
+				t.Fatal(err)
+			}
+
+			// as the server streams it to the client
+			sent, err := proto.Marshal(InternalToExternalEvent(cached))
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := new(WebhookEvent)
+			if err := proto.Unmarshal(sent, received); err != nil {
+				t.Fatal(err)
+			}
+
+			// as the client caches and relays it
+			got := EventHeadersToHTTPHeaders(ExternalToInternalEvent(received).Headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headers after round trip = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalLegacyHeader(t *testing.T) {
+	header := new(WebhookEventHeader)
+	if err := json.Unmarshal([]byte(`{"key":"X-Github-Event","firstValue":"push"}`), header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Key != "X-Github-Event" || !reflect.DeepEqual(header.Values, []string{"push"}) {
+		t.Errorf("legacy header = %+v, want X-Github-Event with value push", header)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/ecdh"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"github.com/joostvdg/gitstafette/internal/cache"
 	"github.com/joostvdg/gitstafette/internal/config"
 	gcontext "github.com/joostvdg/gitstafette/internal/context"
+	"github.com/joostvdg/gitstafette/internal/e2e"
 	grpc_internal "github.com/joostvdg/gitstafette/internal/grpc"
 	"github.com/joostvdg/gitstafette/internal/info"
 	"github.com/joostvdg/gitstafette/internal/otel_util"
@@ -28,31 +30,40 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-// TODO do not close if we have not relayed our events yet!
+var tracer trace.Tracer
 
-var requestInterval = time.Second * 5
+const (
+	envOauthToken = "OAUTH_TOKEN"
 
-var tracer trace.Tracer
+	// large enough for a batch of events at GitHub's maximum payload size of 25 MB
+	defaultMaxMessageSize = 64 * 1024 * 1024
 
-const envOauthToken = "OAUTH_TOKEN"
+	// how long we try to acknowledge the events received while shutting down, the stream is gone by then
+	shutdownAcknowledgeTimeout = 5 * time.Second
+)
 
 func main() {
 	name := flag.String("name", "GSF-Relay", "Name of the GitstafetteServer")
 	grpcServerPort := flag.String("port", "50051", "Port used for connecting to the GRPC Server")
-	grpcServerHost := flag.String("server", "127.0.0.1", "Server host to connect to")
+	grpcServerHost := flag.String("server", "127.0.0.1", "Comma separated server hosts to connect to, optionally host:port, we fail over to the next one when a server cannot be reached")
+	reconnectBackoff := flag.Duration("reconnectBackoff", time.Second, "How long we wait before reconnecting to a server, doubling after every failed attempt")
+	maxReconnectBackoff := flag.Duration("maxReconnectBackoff", time.Minute, "The longest we wait before reconnecting to a server")
 	grpcServerInsecure := flag.Bool("insecure", false, "If the grpc streaming config should be handled insecurely, must provide either `secure` or `insecure` flag")
 	grpcServerSecure := flag.Bool("secure", false, "If the grpc streaming config should be handled securely, must provide either `secure` or `insecure` flag")
-	repositoryId := flag.String("repo", "", "GitHub Repository ID to receive webhook events for")
+	repositoryId := flag.String("repo", "", "Comma separated GitHub Repository IDs, full names (owner/name), or patterns (owner/*) to receive webhook events for on one stream")
 	grpcInfoPort := flag.String("infoPort", "50052", "Port used for connecting to the GRPC Info Server")
 	relayEnabled := flag.Bool("relayEnabled", false, "If the config should relay received events, rather than caching them for clients")
 	relayHost := flag.String("relayHost", "127.0.0.1", "Host address to relay events to")
@@ -61,13 +72,20 @@ func main() {
 	relayPort := flag.String("relayPort", "50051", "The port of the relay address")
 	relayProtocol := flag.String("relayProtocol", "grpc", "The protocol for the relay address (grpc, or http)")
 	relayInsecure := flag.Bool("relayInsecure", false, "If the relay config should be handled insecurely")
+	relayRoutes := flag.String("relayRoutes", "", "Comma separated repository=path pairs, relaying the events of a repository (ID or full name) to its own path on the relay host")
 	caFileLocation := flag.String("caFileLocation", "", "The root CA file for trusting clients using TLS connection")
 	certFileLocation := flag.String("certFileLocation", "", "The certificate file for trusting clients using TLS connection")
 	certKeyFileLocation := flag.String("certKeyFileLocation", "", "The certificate key file for trusting clients using TLS connection")
 	clientId := flag.String("clientId", "gitstafette-client", "The id of the client to identify connections")
-	streamWindow := flag.Int("streamWindow", 180, "The time we spend streaming with the server, in seconds")
+	streamWindow := flag.Int("streamWindow", 0, "The time we spend streaming with the server before reconnecting, in seconds (default is until the server asks us to reconnect)")
 	healthCheckPort := flag.String("healthCheckPort", "8080", "Port used for a http health check server, used for running in container environments")
 	webhookHMAC := flag.String("webhookHMAC", "", "The hmac token used to verify the webhook events")
+	compression := flag.String("compression", "none", "Compression for messages sent to the server (gzip, or none), responses are compressed when the server supports it")
+	maxMessageSize := flag.Int("maxMessageSize", defaultMaxMessageSize, "The maximum size in bytes of a message received from the server")
+	endToEndKeyFileLocation := flag.String("endToEndKeyFileLocation", "", "The private key file (created if missing) for end-to-end encryption, its public key is registered with the server so only this client can read event bodies")
+	outboxDirectory := flag.String("outboxDirectory", "", "Directory to keep received events in until they are relayed, so they survive restarts, events are only acknowledged to the server once written (default is in memory)")
+	drainTimeout := flag.Duration("drainTimeout", 30*time.Second, "How long we keep relaying the events already received when stopping, before giving up on those that remain")
+	registerRepository := flag.Bool("registerRepository", false, "If the client registers its repository with the server, for servers that accept repository registrations rather than configuring the repositories")
 	flag.Parse()
 
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -89,12 +107,12 @@ func main() {
 		tracer = tp.Tracer("gsf-client")
 	}
 
-	relayConfig, err := api.CreateRelayConfig(*relayEnabled, *relayHost, *relayPath, *relayHealthCheckPath, *relayPort, *relayProtocol, *relayInsecure)
+	relayConfig, err := api.CreateRelayConfig(*relayEnabled, *relayHost, *relayPath, *relayHealthCheckPath, *relayPort, *relayProtocol, *relayInsecure, *relayRoutes)
 	if err != nil {
 		sublogger.Fatal().Err(err).Msg("Malformed Relay URL")
 	}
 
-	repoIds := []string{*repositoryId}
+	repoIds := strings.Split(*repositoryId, ",")
 	serverConfig := &api.ServerConfig{
 		Name:         *name,
 		Host:         "localhost",
@@ -108,8 +126,15 @@ func main() {
 		Context: ctx,
 		Relay:   relayConfig,
 	}
-	relay.InitiateRelay(serviceContext, *repositoryId)
 	cache.InitCache(*repositoryId, nil)
+	if *outboxDirectory != "" {
+		loaded, err := cache.EnableOutbox(*outboxDirectory)
+		if err != nil {
+			sublogger.Fatal().Err(err).Msg("Could not open the outbox")
+		}
+		sublogger.Info().Msgf("Keeping received events in outbox %v, loaded %d events not yet relayed", *outboxDirectory, loaded)
+	}
+	relays := relay.InitiateRelay(serviceContext, repoIds)
 	go initHealthCheckServer(ctx, *healthCheckPort)
 
 	insecure := *grpcServerInsecure
@@ -122,35 +147,108 @@ func main() {
 		oauthToken = ""
 	}
 
-	tlsConfig, err := config.NewTLSConfig(*caFileLocation, *certFileLocation, *certKeyFileLocation, false)
+	tlsConfig, err := config.NewTLSConfig(ctx, *caFileLocation, *certFileLocation, *certKeyFileLocation, false)
 	if err != nil {
 		sublogger.Fatal().Err(err).Msg("Invalid certificate configuration")
 	}
 
-	grpcServerConfig := api.CreateServerConfig(*grpcServerHost, *grpcServerPort, *streamWindow, insecure, oauthToken, tlsConfig)
-	grpcClientConfig := api.CreateClientConfig(*clientId, *repositoryId, *streamWindow, *webhookHMAC)
+	grpcCompression := *compression
+	if grpcCompression == "none" {
+		grpcCompression = ""
+	} else if grpcCompression != gzip.Name {
+		sublogger.Fatal().Msgf("Unsupported compression: %v", grpcCompression)
+	}
 
-	for {
-		err := handleWebhookEventStream(grpcServerConfig, grpcClientConfig, ctx)
+	grpcServerConfigs := make([]*api.GRPCServerConfig, 0)
+	for _, address := range serverAddresses(*grpcServerHost, *grpcServerPort) {
+		grpcServerConfigs = append(grpcServerConfigs, api.CreateServerConfig(address.host, address.port, *streamWindow, insecure, oauthToken, tlsConfig, grpcCompression, *maxMessageSize))
+	}
+	if len(grpcServerConfigs) == 0 {
+		sublogger.Fatal().Msg("No server to connect to")
+	}
+	var endToEndKey *ecdh.PrivateKey
+	if *endToEndKeyFileLocation != "" {
+		endToEndKey, err = e2e.LoadOrCreatePrivateKey(*endToEndKeyFileLocation)
 		if err != nil {
-			sublogger.Fatal().Err(err).Msg("Error streaming from server")
+			sublogger.Fatal().Err(err).Msg("Invalid end-to-end encryption key")
 		}
+	}
+	grpcClientConfig := api.CreateClientConfig(*clientId, repoIds, *streamWindow, *webhookHMAC, endToEndKey, *registerRepository, *outboxDirectory != "")
+
+	// the last event received per repository, so a new stream resumes where the previous one ended
+	cursors := make(map[string]uint64)
+	reconnect := &backoff{initial: *reconnectBackoff, max: *maxReconnectBackoff}
+	server := 0
+	for ctx.Err() == nil {
+		grpcServerConfig := grpcServerConfigs[server]
+		err := handleWebhookEventStream(grpcServerConfig, grpcClientConfig, cursors, reconnect, ctx)
 		if ctx.Err() != nil {
 			log.Info().Msgf("[Main-in] Closing FetchWebhookEvents (context error: %v)", ctx.Err())
 			break
 		}
-		if ctx.Done() != nil && ctx.Err() == nil {
-			log.Info().Msg("[Main] Restarting FetchWebhookEvents as context expired but no error occurred")
-			ctx, _ = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		if err != nil && !errors.Is(err, errServerDraining) {
+			if !isRetryable(err) {
+				sublogger.Fatal().Err(err).Msg("Error streaming from server")
+			}
+			sublogger.Warn().Err(err).Msgf("Error streaming from server %v:%v", grpcServerConfig.Host, grpcServerConfig.Port)
+		}
+		if err != nil {
+			// a failing or draining server is left for the next one, if there is one
+			server = (server + 1) % len(grpcServerConfigs)
+		}
+
+		sleepTime := reconnect.next()
+		sublogger.Info().Msgf("Reconnecting to %v:%v in %v", grpcServerConfigs[server].Host, grpcServerConfigs[server].Port, sleepTime)
+		select {
+		case <-time.After(sleepTime):
+		case <-ctx.Done():
 		}
-		// TODO: add exponential backoff in case we fail to connect to the server
-		sleepTime := time.Second * 3
-		sublogger.Info().Msgf("Sleeping for %v", sleepTime)
-		time.Sleep(sleepTime)
+	}
+
+	// we no longer fetch events, a second signal stops us without waiting for the drain
+	stop()
+	if relayConfig.Enabled {
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), *drainTimeout)
+		remaining := drainRelay(drainCtx, relays, relayConfig, repoIds)
+		cancelDrain()
+		reportUndelivered(remaining, *outboxDirectory != "")
 	}
 	sublogger.Info().Msg("Closing client")
 }
 
+// drainRelay waits for the relays to stop, then relays the events that remain until the context is done,
+// and returns per repository how many could not be relayed
+func drainRelay(ctx context.Context, relays *sync.WaitGroup, relayConfig *api.RelayConfig, repositoryIds []string) map[string]int {
+	stopped := make(chan struct{})
+	go func() {
+		relays.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// a relay is still busy with an event, relaying alongside it could send that event twice
+		return cache.UnrelayedEvents(repositoryIds)
+	}
+	log.Info().Msg("Relaying the events already received before closing")
+	return relay.DrainCachedEvents(ctx, relayConfig, repositoryIds)
+}
+
+// reportUndelivered logs the events we stop without relaying, which the outbox keeps for the next start
+func reportUndelivered(remaining map[string]int, outbox bool) {
+	if len(remaining) == 0 {
+		log.Info().Msg("Relayed all received events")
+		return
+	}
+	for repositoryId, count := range remaining {
+		if outbox {
+			log.Warn().Msgf("%d events of repository %v are not relayed, they are kept in the outbox for the next start", count, cache.DescribeRepository(repositoryId))
+		} else {
+			log.Error().Msgf("%d events of repository %v are not relayed and are lost", count, cache.DescribeRepository(repositoryId))
+		}
+	}
+}
+
 func runInfoServer(ctx context.Context, serverConfig *api.ServerConfig, relayConfig *api.RelayConfig, grpcPort string) {
 	grpcServer := grpc.NewServer()
 	go func(s *grpc.Server) {
@@ -202,7 +300,7 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleWebhookEventStream(serverConfig *api.GRPCServerConfig, clientConfig *api.GRPCClientConfig, mainCtx context.Context) error {
+func handleWebhookEventStream(serverConfig *api.GRPCServerConfig, clientConfig *api.GRPCClientConfig, cursors map[string]uint64, reconnect *backoff, mainCtx context.Context) error {
 	grpcOpts := createGrpcOptions(serverConfig)
 	address := serverConfig.Host + ":" + serverConfig.Port
 	conn, err := grpc.NewClient(address, grpcOpts...)
@@ -231,76 +329,116 @@ func handleWebhookEventStream(serverConfig *api.GRPCServerConfig, clientConfig *
 		connectionCtx = spanContext
 	}
 
-	sublogger.Info().Msg("[handleWebhookEventStream] Starting FetchWebhookEvents")
 	client := api.NewGitstafetteClient(conn)
+	if clientConfig.RegisterRepository {
+		// like the key, registering on every connection means a restarted server watches our repository again
+		if err := registerRepository(connectionCtx, client, clientConfig); err != nil {
+			return err
+		}
+	}
+	if clientConfig.EndToEndKey != nil {
+		// registering on every connection means a restarted server still knows our key
+		if err := registerClientKey(connectionCtx, client, clientConfig); err != nil {
+			return err
+		}
+	}
+
+	sublogger.Info().Msg("[handleWebhookEventStream] Starting FetchWebhookEvents")
+	if len(cursors) > 0 {
+		sublogger.Info().Msgf("[handleWebhookEventStream] Resuming after events %v", cursors)
+	}
 	request := &api.WebhookEventsRequest{
 		ClientId:            clientConfig.ClientID,
-		RepositoryId:        clientConfig.RepositoryId,
+		RepositoryId:        clientConfig.RepositoryIds[0],
+		RepositoryIds:       clientConfig.RepositoryIds[1:],
 		LastReceivedEventId: 0,
 		DurationSecs:        uint32(serverConfig.StreamWindow),
+		TypedResponses:      true,
+		Cursors:             cursors,
+		AcknowledgeEvents:   clientConfig.AcknowledgeEvents,
 	}
 
 	stream, err := client.FetchWebhookEvents(connectionCtx, request)
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not fetch webhook events")
+		return fmt.Errorf("could not fetch webhook events: %w", err)
 	}
 
-	finish := time.Now().Add(time.Second * time.Duration(clientConfig.StreamWindow))
+	var finish <-chan time.Time
+	if clientConfig.StreamWindow > 0 {
+		finish = time.After(time.Second * time.Duration(clientConfig.StreamWindow))
+	}
+	// the server pushes events as they arrive, so we wait on them rather than on a clock
+	responses, receiveErrors := receiveWebhookEvents(stream)
+	draining := false
 
 timed:
-	for time.Now().Before(finish) {
+	for {
 		select {
-		case <-time.After(requestInterval):
-			otel_util.AddSpanEvent(span, "requesting stream")
-			response, err := stream.Recv()
+		case <-finish:
+			sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (stream window passed)")
+			break timed
+		case err := <-receiveErrors:
 			if err == io.EOF {
 				sublogger.Info().Msg("Server send end of stream, closing")
 				break timed
 			}
-			if err != nil {
-				sublogger.Warn().Msgf("Error receiving stream: %v\n", err) // is this recoverable or not?
-				return err
+			if mainCtx.Err() != nil {
+				sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (mainCtx done)")
+				break timed
 			}
-
-			sublogger.Info().Msgf("Received %d WebhookEvents", len(response.WebhookEvents))
-			otel_util.AddSpanEventWithOption(span, "EventsReceived", trace.WithAttributes(attribute.Int("events", len(response.WebhookEvents))))
-
-			if len(response.WebhookEvents) > 0 {
-
-				if otelEnabled {
-					_, span := otel.Tracer("Client").Start(connectionCtx, "EventsReceived", trace.WithSpanKind(trace.SpanKindClient))
-					defer span.End()
-					span.AddEvent("EventsReceived", trace.WithAttributes(attribute.Int("events", len(response.WebhookEvents))))
+			sublogger.Warn().Msgf("Error receiving stream: %v\n", err) // is this recoverable or not?
+			return err
+		case response := <-responses:
+			otel_util.AddSpanEvent(span, "received from stream")
+			// the server is there and serving us, so a next reconnect need not wait long
+			reconnect.reset()
+			if heartbeat := response.GetHeartbeat(); heartbeat != nil {
+				sublogger.Debug().Msgf("Received heartbeat, sent %v ago", time.Since(time.UnixMilli(heartbeat.SentAtUnixMillis)))
+				continue
+			}
+			if notice := response.GetNotice(); notice != nil {
+				sublogger.Info().Msgf("Received notice from server (%v): %v", notice.Kind, notice.Description)
+				if notice.Kind == api.NoticeKind_NOTICE_KIND_DRAINING {
+					otel_util.AddSpanEvent(span, "server draining")
+					draining = true
+					break timed
 				}
+				continue
+			}
+			webhookEvents := api.ResponseEvents(response)
 
-				for _, event := range response.WebhookEvents {
-
-					sublogger.Printf("[handleWebhookEventStream] InternalEvent: %s, body size: %d, number of headers:  %d\n", event.EventId, len(event.Body), len(event.Headers))
-					eventIsValid := v1.ValidateEvent(clientConfig.WebhookHMAC, event)
-					messageAddition := ""
-					if clientConfig.WebhookHMAC != "" {
-						messageAddition = " against hmac token on digest header"
-					}
-					sublogger.Printf("[handleWebhookEventStream] Event %v is validated"+messageAddition+", valid: %v",
-						event.EventId, eventIsValid)
-					err := cache.Event(clientConfig.RepositoryId, event)
-					if err != nil {
-						return err
-					}
-				}
+			sublogger.Info().Msgf("Received %d WebhookEvents", len(webhookEvents))
+			otel_util.AddSpanEventWithOption(span, "EventsReceived", trace.WithAttributes(attribute.Int("events", len(webhookEvents))))
 
+			if err := storeReceivedEvents(connectionCtx, client, clientConfig, cursors, webhookEvents); err != nil {
+				return err
 			}
-		case <-stream.Context().Done():
-			otel_util.AddSpanEvent(span, "stream context done")
-			sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (stream context done)")
-			break timed
 		case <-mainCtx.Done(): // Activated when ctx.Done() closes
 			otel_util.AddSpanEvent(span, "mainCtx done")
 			sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (mainCtx done)")
+			// a response we already received is stored and acknowledged, so the server need not send it again
+			select {
+			case response := <-responses:
+				ackCtx, cancelAck := context.WithTimeout(context.Background(), shutdownAcknowledgeTimeout)
+				err := storeReceivedEvents(ackCtx, client, clientConfig, cursors, api.ResponseEvents(response))
+				cancelAck()
+				if err != nil {
+					return err
+				}
+			default:
+			}
 			break timed
 		}
 	}
 
+	if draining {
+		sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (server draining)")
+		if otelEnabled {
+			span.SetStatus(codes.Ok, "Server Draining")
+			span.AddEvent("finish")
+		}
+		return errServerDraining
+	}
 	if stream.Context().Err() != nil {
 		sublogger.Info().Msg("[handleWebhookEventStream] Closing FetchWebhookEvents (stream context error)")
 		if otelEnabled {
@@ -317,12 +455,166 @@ timed:
 	return nil
 }
 
+// storeReceivedEvents caches the events per repository for the relay, and acknowledges those we stored, or can never
+// store, when the server waits for acknowledgements
+func storeReceivedEvents(ctx context.Context, client api.GitstafetteClient, clientConfig *api.GRPCClientConfig, cursors map[string]uint64, webhookEvents []*api.WebhookEvent) error {
+	if len(webhookEvents) == 0 {
+		return nil
+	}
+	if otel_util.IsOTelEnabled() {
+		_, span := otel.Tracer("Client").Start(ctx, "EventsReceived", trace.WithSpanKind(trace.SpanKindClient))
+		defer span.End()
+		span.AddEvent("EventsReceived", trace.WithAttributes(attribute.Int("events", len(webhookEvents))))
+	}
+
+	// the events we stored per repository, those we cannot decrypt stay pending on the server until a client can
+	received := make(map[string][]string)
+	for _, event := range webhookEvents {
+		// cached per repository, so the relay can route each to its own repository
+		repositoryId := event.RepositoryId
+		if repositoryId == "" {
+			repositoryId = clientConfig.RepositoryIds[0]
+		}
+		if event.Encryption != nil {
+			if err := decryptEvent(clientConfig, event); err != nil {
+				log.Warn().Err(err).Msgf("[handleWebhookEventStream] Skipping event %s, leaving it unacknowledged", event.EventId)
+				continue
+			}
+		}
+
+		log.Printf("[handleWebhookEventStream] InternalEvent: %s, body size: %d, number of headers:  %d\n", event.EventId, len(event.Body), len(event.Headers))
+		eventIsValid := v1.ValidateEvent(clientConfig.WebhookHMAC, event)
+		messageAddition := ""
+		if clientConfig.WebhookHMAC != "" {
+			messageAddition = " against hmac token on digest header"
+		}
+		log.Printf("[handleWebhookEventStream] Event %v is validated"+messageAddition+", valid: %v",
+			event.EventId, eventIsValid)
+		if event.RepositoryName != "" && !cache.IsRepositoryName(repositoryId) {
+			// the server only knows names from verified webhooks, we need them to route events given by name
+			cache.LearnRepositoryName(repositoryId, event.RepositoryName)
+		}
+		err := cache.Event(repositoryId, event)
+		if err != nil {
+			return err
+		}
+		cursors[repositoryId] = max(cursors[repositoryId], event.Sequence)
+		received[repositoryId] = append(received[repositoryId], event.EventId)
+	}
+	if clientConfig.AcknowledgeEvents {
+		acknowledgeEvents(ctx, client, clientConfig, received)
+	}
+	return nil
+}
+
+// receiveWebhookEvents receives the responses of the stream until it ends, with the error that ended it
+func receiveWebhookEvents(stream api.Gitstafette_FetchWebhookEventsClient) (<-chan *api.WebhookEventsResponse, <-chan error) {
+	// one buffered response is stored when we stop, rather than lost with the stream
+	responses := make(chan *api.WebhookEventsResponse, 1)
+	receiveErrors := make(chan error, 1)
+	go func() {
+		for {
+			response, err := stream.Recv()
+			if err != nil {
+				receiveErrors <- err
+				return
+			}
+			select {
+			case responses <- response:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+	return responses, receiveErrors
+}
+
+// acknowledgeEvents tells the server which events we stored, so it stops sending them. Without an acknowledgement
+// they are sent again on a next stream, the outbox keeps an event only once.
+func acknowledgeEvents(ctx context.Context, client api.GitstafetteClient, clientConfig *api.GRPCClientConfig, eventIds map[string][]string) {
+	for repositoryId, repositoryEventIds := range eventIds {
+		response, err := client.AcknowledgeWebhookEvents(ctx, &api.AcknowledgeWebhookEventsRequest{
+			ClientId:     clientConfig.ClientID,
+			RepositoryId: repositoryId,
+			EventIds:     repositoryEventIds,
+		})
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not acknowledge %d events for repository %v", len(repositoryEventIds), repositoryId)
+			continue
+		}
+		log.Info().Msgf("Acknowledged %d events for repository %v", response.Acknowledged, repositoryId)
+	}
+}
+
+func registerRepository(ctx context.Context, client api.GitstafetteClient, clientConfig *api.GRPCClientConfig) error {
+	for _, repositoryId := range clientConfig.RepositoryIds {
+		response, err := client.RegisterRepository(ctx, &api.RegisterRepositoryRequest{
+			ClientId:     clientConfig.ClientID,
+			RepositoryId: repositoryId,
+		})
+		if err != nil {
+			return fmt.Errorf("could not register repository %v: %w", repositoryId, err)
+		}
+		if !response.Accepted {
+			return fmt.Errorf("server did not accept repository %v: %v", repositoryId, response.ResponseDescription)
+		}
+		log.Info().Msgf("Registered repository %v", repositoryId)
+	}
+	return nil
+}
+
+func registerClientKey(ctx context.Context, client api.GitstafetteClient, clientConfig *api.GRPCClientConfig) error {
+	publicKey := clientConfig.EndToEndKey.PublicKey().Bytes()
+	for _, repositoryId := range clientConfig.RepositoryIds {
+		response, err := client.RegisterClientKey(ctx, &api.RegisterClientKeyRequest{
+			ClientId:     clientConfig.ClientID,
+			RepositoryId: repositoryId,
+			PublicKey:    publicKey,
+		})
+		if err != nil {
+			return fmt.Errorf("could not register end-to-end encryption key for repository %v: %w", repositoryId, err)
+		}
+		if !response.Accepted {
+			return fmt.Errorf("server did not accept end-to-end encryption key for repository %v: %v", repositoryId, response.ResponseDescription)
+		}
+		log.Info().Msgf("Registered end-to-end encryption key %v for repository %v", response.KeyId, repositoryId)
+	}
+	return nil
+}
+
+// decryptEvent replaces the encrypted body of an event with its plaintext
+func decryptEvent(clientConfig *api.GRPCClientConfig, event *api.WebhookEvent) error {
+	if clientConfig.EndToEndKey == nil {
+		return fmt.Errorf("event is end-to-end encrypted, but no key is configured")
+	}
+	if event.Encryption.Algorithm != e2e.Algorithm {
+		return fmt.Errorf("unsupported end-to-end encryption algorithm %q", event.Encryption.Algorithm)
+	}
+	keyId := e2e.KeyID(clientConfig.EndToEndKey.PublicKey().Bytes())
+	if event.Encryption.KeyId != keyId {
+		return fmt.Errorf("event is encrypted for key %v, but our key is %v", event.Encryption.KeyId, keyId)
+	}
+	body, err := e2e.Open(clientConfig.EndToEndKey, event.Encryption.EphemeralPublicKey, event.Body, []byte(event.EventId))
+	if err != nil {
+		return fmt.Errorf("could not decrypt event: %w", err)
+	}
+	event.Body = body
+	event.Encryption = nil
+	return nil
+}
+
 func createGrpcOptions(serverConfig *api.GRPCServerConfig) []grpc.DialOption {
 	sublogger := log.With().Str("component", "grpc-init").Logger()
 
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithAuthority(serverConfig.Host))
 
+	callOpts := []grpc.CallOption{grpc.MaxCallRecvMsgSize(serverConfig.MaxMessageSize)}
+	if serverConfig.Compression != "" {
+		callOpts = append(callOpts, grpc.UseCompressor(serverConfig.Compression))
+	}
+	opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+
 	if serverConfig.OAuthToken != "" {
 		rpcCreds := oauth.TokenSource{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: serverConfig.OAuthToken})}
 		opts = append(opts, grpc.WithPerRPCCredentials(rpcCreds))
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errServerDraining ends a stream the server asked us to leave, we reconnect elsewhere rather than fail
+var errServerDraining = errors.New("server is draining")
+
+// backoff spaces out reconnects exponentially, with jitter so clients do not reconnect to a recovering server all at once
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+}
+
+// next returns how long to wait before the next reconnect, between half and all of the exponential delay
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempts < 32 {
+		delay = min(b.initial<<b.attempts, b.max)
+	}
+	b.attempts++
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// reset starts over from the initial delay, once a stream works again
+func (b *backoff) reset() {
+	b.attempts = 0
+}
+
+// isRetryable tells if reconnecting may help, which it does not when the server rejects who we are or what we ask
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument, codes.FailedPrecondition:
+		return false
+	default:
+		return true
+	}
+}
+
+type serverAddress struct {
+	host string
+	port string
+}
+
+// serverAddresses splits the comma separated servers into hosts and ports, those without a port use the default port
+func serverAddresses(servers string, defaultPort string) []serverAddress {
+	addresses := make([]serverAddress, 0)
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), defaultPort
+		}
+		addresses = append(addresses, serverAddress{host: host, port: port})
+	}
+	return addresses
+}
@@ -6,11 +6,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"strings"
 
 	"github.com/getsentry/sentry-go"
 	sentryecho "github.com/getsentry/sentry-go/echo"
 	internal_api "github.com/joostvdg/gitstafette/internal/api/v1"
+	"github.com/joostvdg/gitstafette/internal/auth"
 	"github.com/joostvdg/gitstafette/internal/cache"
 	"github.com/joostvdg/gitstafette/internal/config"
 	gcontext "github.com/joostvdg/gitstafette/internal/context"
@@ -29,17 +29,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
-	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
 
 	infoapi "github.com/joostvdg/gitstafette/api/info"
 	api "github.com/joostvdg/gitstafette/api/v1"
@@ -49,16 +48,24 @@ import (
 // TODO add flags for target for Relay
 
 const (
-	envSentry        = "SENTRY_DSN"
-	responseInterval = time.Second * 5
+	envSentry         = "SENTRY_DSN"
+	envEncryptionKeys = "GSF_ENCRYPTION_KEYS"
+	envOauthToken     = "OAUTH_TOKEN"
+	responseInterval  = time.Second * 5
+
+	tlsBootstrapSelfSigned = "self-signed"
+	tlsBootstrapACME       = "acme"
+
+	// GitHub caps webhook payloads at 25 MB
+	defaultMaxPayloadSize = 25 * 1024 * 1024
+	// room for the headers and other fields wrapped around a pushed event body
+	grpcMessageOverhead = 1024 * 1024
 )
 
 var (
-	mp                 *sdkmetric.MeterProvider
-	tracer             trace.Tracer
-	otelEnabled        bool
-	errMissingMetadata = status.Errorf(codes.InvalidArgument, "missing metadata")
-	errInvalidToken    = status.Errorf(codes.Unauthenticated, "invalid token")
+	mp          *sdkmetric.MeterProvider
+	tracer      trace.Tracer
+	otelEnabled bool
 )
 
 func main() {
@@ -66,7 +73,10 @@ func main() {
 	port := flag.String("port", "1323", "Port used for hosting the GitstafetteServer")
 	grpcPort := flag.String("grpcPort", "50051", "Port used for hosting the grpc streaming GitstafetteServer")
 	grpcHealthPort := flag.String("grpcHealthPort", "50052", "Port used for hosting the grpc health checks")
-	repositoryIDs := flag.String("repositories", "", "Comma separated list of GitHub repository IDs to listen for")
+	repositoryIDs := flag.String("repositories", "", "Comma separated list of GitHub repository IDs, full names (owner/name), or patterns (owner/*) to listen for, only used when the store has no watch list yet, the watch list API can add more at runtime")
+	repositoryRegistration := flag.Bool("repositoryRegistration", false, "If clients may register the repositories they serve, which are watched until no client connected for them within the registrationGracePeriod")
+	maxStreamAge := flag.Duration("maxStreamAge", 0, "How long a client stream lives before the client is asked to reconnect, spreading clients over servers after scaling (default is indefinitely)")
+	registrationGracePeriod := flag.Duration("registrationGracePeriod", time.Hour, "How long a registered repository is watched after the last client connected for it")
 	redisDatabase := flag.String("redisDatabase", "0", "Database used for redis")
 	redisHost := flag.String("redisHost", "localhost", "Host of the Redis GitstafetteServer")
 	redisPort := flag.String("redisPort", "6379", "Port of the Redis GitstafetteServer")
@@ -78,29 +88,147 @@ func main() {
 	relayPort := flag.String("relayPort", "50051", "The port of the relay address")
 	relayProtocol := flag.String("relayProtocol", "grpc", "The protocol for the relay address (grpc, or http)")
 	relayInsecure := flag.Bool("relayInsecure", false, "If the relay GitstafetteServer should be handled insecurely")
+	relayRoutes := flag.String("relayRoutes", "", "Comma separated repository=path pairs, relaying the events of a repository (ID or full name) to its own path on the relay host")
 	caFileLocation := flag.String("caFileLocation", "", "The root CA file for trusting clients using TLS connection")
 	certFileLocation := flag.String("certFileLocation", "", "The certificate file for trusting clients using TLS connection")
 	certKeyFileLocation := flag.String("certKeyFileLocation", "", "The certificate key file for trusting clients using TLS connection")
-	webhookHMAC := flag.String("webhookHMAC", "", "The hmac token used to verify the webhook events")
+	tlsBootstrap := flag.String("tlsBootstrap", "", "Let the server get its own TLS certificate instead of using certFileLocation: self-signed, or acme (requires the webhook port to receive HTTP-01 challenges on port 80)")
+	tlsHosts := flag.String("tlsHosts", "localhost", "Comma separated host names (or IP addresses for self-signed) the bootstrapped TLS certificate is for")
+	tlsBootstrapDirectory := flag.String("tlsBootstrapDirectory", "gsf-tls", "Directory to store the bootstrapped TLS certificates in")
+	acmeEmail := flag.String("acmeEmail", "", "Contact email for the ACME account")
+	acmeDirectoryURL := flag.String("acmeDirectoryURL", "", "Directory URL of the ACME CA (default is Let's Encrypt)")
+	singlePort := flag.Bool("singlePort", false, "If the webhook API, GRPC and GRPC health should all be served on the port, instead of grpcPort and grpcHealthPort")
+	grpcWeb := flag.Bool("grpcWeb", false, "If the GRPC services should also be served with gRPC-Web and Connect on the webhook port, for browsers and curl")
+	grpcWebAllowedOrigins := flag.String("grpcWebAllowedOrigins", "", "Comma separated origins of browser apps allowed to call gRPC-Web and Connect, * allows any (default is none)")
+	webhookTLS := flag.Bool("webhookTLS", false, "If the webhook HTTP endpoint should be served over HTTPS, with the same certificate as GRPC")
+	httpRedirectPort := flag.String("httpRedirectPort", "", "Port for plain HTTP that redirects to the HTTPS webhook endpoint and serves ACME challenges, for example 80 (default is none)")
+	tlsMinVersion := flag.String("tlsMinVersion", "1.2", "The minimum TLS version to accept (1.2 or 1.3)")
+	tlsCipherSuites := flag.String("tlsCipherSuites", "", "Comma separated TLS 1.2 cipher suites to accept, for example TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (default is Go's secure suites)")
+	clientCertificateIdentity := flag.Bool("clientCertificateIdentity", false, "If the client certificate (SPIFFE ID, common name or DNS name) identifies GRPC clients without a token, requires the caFileLocation")
+	webhookHMAC := flag.String("webhookHMAC", "", "The hmac token used to verify the webhook events, repository full names are only learned from verified events")
+	maxPayloadSize := flag.Int64("maxPayloadSize", defaultMaxPayloadSize, "The maximum size in bytes of a webhook event body, larger events are rejected (0 means unlimited)")
+	compressAtRest := flag.Bool("compressAtRest", true, "If cached webhook event bodies should be stored compressed")
+	clientCredentialsFileLocation := flag.String("clientCredentialsFileLocation", "", "JSON file with the client credentials and the repositories each client may fetch or push, the "+envOauthToken+" environment variable adds a token valid for any client and repository")
+	jwksLocation := flag.String("jwksLocation", "", "File or URL of the JSON Web Key Set used to validate client JWTs, enables JWT authentication")
+	jwtIssuer := flag.String("jwtIssuer", "", "The issuer client JWTs must have")
+	jwtAudience := flag.String("jwtAudience", "", "The audience client JWTs must have")
+	jwtClientIdClaim := flag.String("jwtClientIdClaim", "sub", "The JWT claim holding the client id")
+	jwtRepositoriesClaim := flag.String("jwtRepositoriesClaim", "repositories", "The JWT claim holding the repositories a client may fetch, additional repositories can be granted in the client credentials file")
+	encryptionKeyFileLocation := flag.String("encryptionKeyFileLocation", "", "File with the keys (keyId:base64Key per line, last one is active) for encrypting cached webhook events, alternatively set "+envEncryptionKeys)
 	flag.Parse()
 
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
-	tlsConfig, err := config.NewTLSConfig(*caFileLocation, *certFileLocation, *certKeyFileLocation, true)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	var acmeManager *autocert.Manager
+	var tlsConfig *tls.Config
+	switch *tlsBootstrap {
+	case "":
+		tlsConfig, err = config.NewTLSConfig(ctx, *caFileLocation, *certFileLocation, *certKeyFileLocation, true)
+	case tlsBootstrapSelfSigned:
+		*certFileLocation, *certKeyFileLocation, err = config.SelfSignedCertificate(*tlsBootstrapDirectory, strings.Split(*tlsHosts, ","))
+		if err == nil {
+			tlsConfig, err = config.NewTLSConfig(ctx, *caFileLocation, *certFileLocation, *certKeyFileLocation, true)
+		}
+	case tlsBootstrapACME:
+		acmeManager, err = config.NewACMEManager(strings.Split(*tlsHosts, ","), *tlsBootstrapDirectory, *acmeEmail, *acmeDirectoryURL)
+		if err == nil {
+			tlsConfig, err = config.NewACMETLSConfig(ctx, acmeManager, *caFileLocation)
+		}
+	default:
+		err = fmt.Errorf("unknown TLS bootstrap %q", *tlsBootstrap)
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msg("Invalid certificate configuration")
 	}
+	var webhookTLSConfig *tls.Config
+	if tlsConfig != nil {
+		if err := applyTLSOptions(tlsConfig, *tlsMinVersion, *tlsCipherSuites); err != nil {
+			log.Fatal().Err(err).Msg("Invalid TLS options")
+		}
+		if *webhookTLS {
+			webhookTLSConfig = config.WithoutClientCertificates(tlsConfig)
+		}
+	}
+	if *webhookTLS && (webhookTLSConfig == nil || (webhookTLSConfig.GetCertificate == nil && len(webhookTLSConfig.Certificates) == 0)) {
+		log.Fatal().Msg("Serving the webhook endpoint over HTTPS requires a certificate or a TLS bootstrap")
+	}
+	legacyToken, _ := os.LookupEnv(envOauthToken)
+	var jwtConfig *auth.JWTConfig
+	if *jwksLocation != "" {
+		jwtConfig = &auth.JWTConfig{
+			JWKSLocation:      *jwksLocation,
+			Issuer:            *jwtIssuer,
+			Audience:          *jwtAudience,
+			ClientIDClaim:     *jwtClientIdClaim,
+			RepositoriesClaim: *jwtRepositoriesClaim,
+		}
+	}
+	authorizer, err := auth.LoadAuthorizer(*clientCredentialsFileLocation, legacyToken, jwtConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid client credentials")
+	}
+	if *clientCertificateIdentity {
+		if tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			log.Fatal().Msg("Identifying clients by certificate requires a CA to verify client certificates")
+		}
+		authorizer.EnableCertificateIdentity()
+	}
+	if *singlePort && tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		// webhook callers have no client certificate, so on a shared port the certificate no longer keeps clients out
+		if !authorizer.Enabled() {
+			log.Fatal().Msg("Client certificates are optional on a single port, which requires client credentials to authenticate GRPC clients")
+		}
+		if !authorizer.CertificateIdentityEnabled() {
+			log.Warn().Msg("Client certificates are optional on a single port, GRPC clients are only authenticated by their credentials")
+		}
+	}
+	if *grpcWeb && !authorizer.Enabled() {
+		// the webhook port asks for no client certificate, so only client credentials keep callers out
+		log.Fatal().Msg("Serving gRPC-Web and Connect on the webhook port requires client credentials to authenticate clients")
+	}
+	// access lists may name repositories by ID or by full name
+	authorizer.ResolveRepositoriesWith(cache.RepositoryAliases)
 	redisConfig := &cache.RedisConfig{
 		Host:     *redisHost,
 		Port:     *redisPort,
 		Password: *redisPassword,
 		Database: *redisDatabase,
 	}
+	if *compressAtRest {
+		cache.EnableCompression()
+	}
+	if *encryptionKeyFileLocation != "" {
+		keyring, err := cache.LoadKeyring(*encryptionKeyFileLocation)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid encryption key file")
+		}
+		cache.EnableEncryption(keyring)
+	} else if encryptionKeys, ok := os.LookupEnv(envEncryptionKeys); ok {
+		keyring, err := cache.ParseKeyring(encryptionKeys)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid encryption keys in " + envEncryptionKeys)
+		}
+		cache.EnableEncryption(keyring)
+	}
+	if *repositoryIDs == "" && !*repositoryRegistration {
+		log.Fatal().Msg("Did not receive any RepositoryID to watch, set repositories or enable repositoryRegistration")
+	}
+	if *webhookHMAC == "" {
+		for _, repository := range strings.Split(*repositoryIDs, ",") {
+			if cache.IsRepositoryName(repository) || cache.IsRepositoryPattern(repository) {
+				log.Fatal().Str("repository", repository).Msg("Watching repositories by name or pattern requires the webhookHMAC, as names are only learned from verified webhooks")
+			}
+		}
+		if *repositoryRegistration {
+			log.Warn().Msg("Without the webhookHMAC, repositories registered by name or pattern receive no events")
+		}
+	}
 	repoIds := cache.InitCache(*repositoryIDs, redisConfig)
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
-
 	otelEnabled = otel_util.IsOTelEnabled()
 	if otelEnabled {
 		log.Info().Msg("OTEL is enabled")
@@ -119,16 +247,23 @@ func main() {
 		log.Info().Msg("OTEL is disabled")
 	}
 
-	relayConfig, err := api.CreateRelayConfig(*relayEnabled, *relayHost, *relayPath, *relayHealthCheckPath, *relayPort, *relayProtocol, *relayInsecure)
+	relayConfig, err := api.CreateRelayConfig(*relayEnabled, *relayHost, *relayPath, *relayHealthCheckPath, *relayPort, *relayProtocol, *relayInsecure, *relayRoutes)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Malformed URL")
 	}
+	if *singlePort {
+		*grpcPort = *port
+		*grpcHealthPort = *port
+	}
 	serverConfig := &api.ServerConfig{
 		Name:         *name,
 		Host:         "localhost",
 		Port:         *port,
 		GrpcPort:     *grpcPort,
 		Repositories: repoIds,
+
+		RepositoryRegistration: *repositoryRegistration,
+		MaxStreamAge:           *maxStreamAge,
 	}
 
 	initSentry() // has to happen before we init Echo
@@ -137,8 +272,22 @@ func main() {
 		grpcHealthServer = initializeGRPCHealthServer(*grpcHealthPort)
 	}
 
-	grpcServer := initializeGRPCServer(*grpcPort, tlsConfig, grpcHealthServer, ctx, serverConfig, relayConfig)
-	echoServer := initializeEchoServer(relayConfig, *port, *webhookHMAC)
+	var grpcServer *grpc.Server
+	var echoServer *echo.Echo
+	var singlePortServer *http.Server
+	if *singlePort {
+		// TLS is done by the shared HTTP server, GRPC does not use its own credentials
+		grpcServer = newGRPCServer(nil, grpcHealthServer, serverConfig, relayConfig, *maxPayloadSize, authorizer)
+		echoServer = newEchoServer(relayConfig, *webhookHMAC, *maxPayloadSize, acmeManager, newWebHandler(*grpcWeb, grpcServer, *grpcWebAllowedOrigins), authorizer)
+		singlePortServer = initializeSinglePortServer(*port, tlsConfig, grpcServer, echoServer)
+	} else {
+		grpcServer = initializeGRPCServer(*grpcPort, tlsConfig, grpcHealthServer, ctx, serverConfig, relayConfig, *maxPayloadSize, authorizer)
+		echoServer = initializeEchoServer(relayConfig, *port, *webhookHMAC, *maxPayloadSize, acmeManager, newWebHandler(*grpcWeb, grpcServer, *grpcWebAllowedOrigins), authorizer, webhookTLSConfig)
+	}
+	var redirectServer *http.Server
+	if *httpRedirectPort != "" {
+		redirectServer = initializeRedirectServer(*httpRedirectPort, *port, acmeManager)
+	}
 	log.Printf("Started http GitstafetteServer on: %s, grpc GitstafetteServer on: %s, and grpc health GitstafetteServer on: %s\n", *port, *grpcPort, *grpcHealthPort)
 
 	serviceContext := &gcontext.ServiceContext{
@@ -148,17 +297,18 @@ func main() {
 
 	if relayConfig.Enabled {
 		log.Printf("Relay mode enabled: %v", relayConfig)
-		for _, repoId := range repoIds {
-			// TODO confirm this works for 1 and multiple
-			relay.InitiateRelay(serviceContext, repoId)
-		}
+		relay.InitiateRelay(serviceContext, repoIds)
 	}
 	go relay.CleanupRelayedEvents(serviceContext)
+	if *repositoryRegistration {
+		go cache.ExpireRegistrations(ctx, *registrationGracePeriod)
+	}
 
 	// Wait for interrupt signal to gracefully shut down the config with a timeout of 10 seconds.
 	// Use a buffered channel to avoid missing signals as recommended for signal.Notify
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	// orchestrators such as Kubernetes stop the server with SIGTERM, on either open streams ask their clients to reconnect
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -166,8 +316,18 @@ func main() {
 	if err := echoServer.Shutdown(ctx); err != nil {
 		echoServer.Logger.Fatal(err)
 	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Could not shut down the HTTP redirect server")
+		}
+	}
 	log.Info().Msg("Shutting down GRPC gitstafette GitstafetteServer")
 	grpcServer.GracefulStop()
+	if singlePortServer != nil {
+		if err := singlePortServer.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Could not shut down the single port GitstafetteServer")
+		}
+	}
 	log.Info().Msg("Shutting down GRPC health GitstafetteServer")
 	if *grpcHealthPort != *grpcPort {
 		grpcHealthServer.GracefulStop()
@@ -193,20 +353,57 @@ func initSentry() {
 	}
 }
 
-func initializeEchoServer(relayConfig *api.RelayConfig, port string, webhookHMAC string) *echo.Echo {
+func initializeEchoServer(relayConfig *api.RelayConfig, port string, webhookHMAC string, maxPayloadSize int64, acmeManager *autocert.Manager, webHandler *grpc_internal.WebHandler, authorizer *auth.Authorizer, tlsConfig *tls.Config) *echo.Echo {
+	e := newEchoServer(relayConfig, webhookHMAC, maxPayloadSize, acmeManager, webHandler, authorizer)
+
+	// Start Echo GitstafetteServer
+	go func(echoPort string) {
+		var err error
+		if tlsConfig != nil {
+			e.TLSServer.Addr = ":" + echoPort
+			e.TLSServer.TLSConfig = tlsConfig
+			err = e.StartServer(e.TLSServer)
+		} else {
+			err = e.Start(":" + echoPort)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal("shutting down the Echo GitstafetteServer")
+		}
+	}(port)
+	return e
+}
+
+func newEchoServer(relayConfig *api.RelayConfig, webhookHMAC string, maxPayloadSize int64, acmeManager *autocert.Manager, webHandler *grpc_internal.WebHandler, authorizer *auth.Authorizer) *echo.Echo {
 	e := echo.New()
+	if webHandler != nil {
+		// gRPC-Web and Connect use the GRPC method paths, which have no Echo routes
+		e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				if webHandler.Handles(c.Request()) {
+					webHandler.ServeHTTP(c.Response(), c.Request())
+					return nil
+				}
+				return next(c)
+			}
+		})
+	}
 	e.Use(func(e echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			gitstatefetteContext := &gcontext.GitstafetteContext{
-				Context:     c,
-				WebhookHMAC: webhookHMAC,
-				Relay:       relayConfig,
+				Context:        c,
+				WebhookHMAC:    webhookHMAC,
+				MaxPayloadSize: maxPayloadSize,
+				Relay:          relayConfig,
+				Authorizer:     authorizer,
 			}
 			return e(gitstatefetteContext)
 		}
 	})
 
-	e.Use(middleware.Logger())
+	// logs the path instead of the URI, as the query of a stream may carry an access token
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: strings.Replace(middleware.DefaultLoggerConfig.Format, "${uri}", "${path}", 1),
+	}))
 	e.Use(sentryecho.New(sentryecho.Options{}))
 
 	e.GET("/", func(c echo.Context) error {
@@ -214,15 +411,77 @@ func initializeEchoServer(relayConfig *api.RelayConfig, port string, webhookHMAC
 	})
 	e.POST("/v1/github/", internal_api.HandleGitHubPost)
 	e.GET("/v1/watchlist", internal_api.HandleWatchListGet)
-	e.GET("/v1/events/:repo", internal_api.HandleRetrieveEventsForRepository)
+	if authorizer.Enabled() {
+		// changing the watch list, and pulling, streaming and acknowledging events, is only for authenticated clients
+		e.POST("/v1/watchlist/:repo", internal_api.HandleWatchListPost)
+		e.DELETE("/v1/watchlist/:repo", internal_api.HandleWatchListDelete)
+		e.GET("/v1/events/:repo", internal_api.HandleRetrieveEventsForRepository)
+		e.POST("/v1/events/:repo/ack", internal_api.HandleAcknowledgeEvents)
+		e.GET("/v1/stream/:repo", internal_api.HandleEventStream)
+	} else {
+		log.Info().Msg("Changing the watch list, and pulling or streaming events over REST require client credentials, these endpoints are disabled")
+	}
+	if acmeManager != nil {
+		e.GET("/.well-known/acme-challenge/*", echo.WrapHandler(acmeManager.HTTPHandler(nil)))
+	}
+	return e
+}
 
-	// Start Echo GitstafetteServer
-	go func(echoPort string) {
-		if err := e.Start(":" + echoPort); err != nil && err != http.ErrServerClosed {
-			e.Logger.Fatal("shutting down the Echo GitstafetteServer")
+func newWebHandler(enabled bool, grpcServer *grpc.Server, allowedOrigins string) *grpc_internal.WebHandler {
+	if !enabled {
+		return nil
+	}
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
 		}
-	}(port)
-	return e
+	}
+	return grpc_internal.NewWebHandler(grpcServer, origins)
+}
+
+// initializeRedirectServer redirects plain HTTP to the HTTPS webhook endpoint, except for ACME challenges it serves itself
+func initializeRedirectServer(redirectPort string, httpsPort string, acmeManager *autocert.Manager) *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if acmeManager != nil {
+		handler = acmeManager.HTTPHandler(handler)
+	}
+	redirectServer := &http.Server{
+		Addr:              ":" + redirectPort,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Could not start the HTTP redirect server")
+		}
+	}()
+	log.Info().Msgf("Redirecting HTTP on port %v to HTTPS on port %v", redirectPort, httpsPort)
+	return redirectServer
+}
+
+// applyTLSOptions sets the minimum version and cipher suites for both the GRPC and the webhook endpoint
+func applyTLSOptions(tlsConfig *tls.Config, minVersion string, cipherSuites string) error {
+	version, err := config.ParseTLSVersion(minVersion)
+	if err != nil {
+		return err
+	}
+	suites, err := config.ParseCipherSuites(cipherSuites)
+	if err != nil {
+		return err
+	}
+	tlsConfig.MinVersion = version
+	tlsConfig.CipherSuites = suites
+	return nil
 }
 
 var kaep = keepalive.EnforcementPolicy{
@@ -238,36 +497,8 @@ var kasp = keepalive.ServerParameters{
 	Timeout:               10 * time.Second, // Wait 1 second for the ping ack before assuming the connection is dead
 }
 
-// valid validates the authorization.
-func valid(authorization []string) bool {
-	if len(authorization) < 1 {
-		return false
-	}
-	token := strings.TrimPrefix(authorization[0], "Bearer ")
-	// Perform the token validation here. For the sake of this example, the code
-	// here forgoes any of the usual OAuth2 token validation and instead checks
-	// for a token matching an arbitrary string.
-	return token == "some-secret-token"
-}
-
-func unaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
-	// authentication (token verification)
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return nil, errMissingMetadata
-	}
-	if !valid(md["authorization"]) {
-		return nil, errInvalidToken
-	}
-	m, err := handler(ctx, req)
-	if err != nil {
-		log.Error().Err(err).Msg("RPC failed")
-	}
-	return m, err
-}
-
 func initializeGRPCHealthServer(grpcPort string) *grpc.Server {
-	grpcServer := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(kaep), grpc.KeepaliveParams(kasp), grpc.UnaryInterceptor(unaryInterceptor))
+	grpcServer := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(kaep), grpc.KeepaliveParams(kasp))
 
 	go func(s *grpc.Server) {
 		grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%s", grpcPort))
@@ -284,18 +515,8 @@ func initializeGRPCHealthServer(grpcPort string) *grpc.Server {
 	return grpcServer
 }
 
-func initializeGRPCServer(grpcPort string, tlsConfig *tls.Config, healthServer *grpc.Server, ctx context.Context, serverConfig *api.ServerConfig, relayConfig *api.RelayConfig) *grpc.Server {
-	grpcServer := grpc.NewServer(
-		grpc.ChainStreamInterceptor(grpc_internal.ValidateToken),
-	)
-
-	if tlsConfig != nil {
-		serverCredentials := credentials.NewTLS(tlsConfig)
-		grpcServer = grpc.NewServer(
-			grpc.Creds(serverCredentials),
-			grpc.ChainStreamInterceptor(grpc_internal.ValidateToken),
-		)
-	}
+func initializeGRPCServer(grpcPort string, tlsConfig *tls.Config, healthServer *grpc.Server, ctx context.Context, serverConfig *api.ServerConfig, relayConfig *api.RelayConfig, maxPayloadSize int64, authorizer *auth.Authorizer) *grpc.Server {
+	grpcServer := newGRPCServer(tlsConfig, healthServer, serverConfig, relayConfig, maxPayloadSize, authorizer)
 
 	go func(s *grpc.Server) {
 		grpcListener, err := net.Listen("tcp", fmt.Sprintf(":%s", grpcPort))
@@ -304,24 +525,6 @@ func initializeGRPCServer(grpcPort string, tlsConfig *tls.Config, healthServer *
 		}
 
 		log.Printf("Starting GRPC GitstafetteServer")
-		api.RegisterGitstafetteServer(s, &server.GitstafetteServer{
-			Tracer:           tracer,
-			MeterProvider:    mp,
-			ResponseInterval: responseInterval,
-		})
-		infoapi.RegisterInfoServer(s, &info.InfoServer{
-			RelayConfig:  relayConfig,
-			ServerConfig: serverConfig,
-			Tracer:       tracer,
-			Type:         infoapi.InstanceType_SERVER,
-		})
-		if healthServer == nil {
-			log.Info().Msg("GRPC HealthCheck GitstafetteServer is empty, running service with normal GRPC GitstafetteServer")
-			grpc_health_v1.RegisterHealthServer(s, &grpc_internal.HealthCheckService{})
-		} else {
-			log.Printf("Running GRPC HealthCheck GitstafetteServer standalone: %v\n", s.GetServiceInfo())
-		}
-
 		if err := s.Serve(grpcListener); err != nil {
 			log.Fatal().Err(err).Msg("failed to serve")
 		}
@@ -329,3 +532,42 @@ func initializeGRPCServer(grpcPort string, tlsConfig *tls.Config, healthServer *
 	}(grpcServer)
 	return grpcServer
 }
+
+// newGRPCServer creates the GRPC server with all services registered, the health service only if there is no standalone health server
+func newGRPCServer(tlsConfig *tls.Config, healthServer *grpc.Server, serverConfig *api.ServerConfig, relayConfig *api.RelayConfig, maxPayloadSize int64, authorizer *auth.Authorizer) *grpc.Server {
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpc_internal.UnaryAuthInterceptor(authorizer)),
+		grpc.ChainStreamInterceptor(grpc_internal.StreamAuthInterceptor(authorizer), grpc_internal.NegotiateCompression),
+	}
+	if maxPayloadSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(int(maxPayloadSize)+grpcMessageOverhead))
+	}
+	if tlsConfig != nil {
+		serverCredentials := credentials.NewTLS(tlsConfig)
+		serverOptions = append(serverOptions, grpc.Creds(serverCredentials))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
+
+	api.RegisterGitstafetteServer(grpcServer, &server.GitstafetteServer{
+		Tracer:           tracer,
+		MeterProvider:    mp,
+		ResponseInterval: responseInterval,
+
+		RepositoryRegistration: serverConfig.RepositoryRegistration,
+		MaxStreamAge:           serverConfig.MaxStreamAge,
+		Authorizer:             authorizer,
+	})
+	infoapi.RegisterInfoServer(grpcServer, &info.InfoServer{
+		RelayConfig:  relayConfig,
+		ServerConfig: serverConfig,
+		Tracer:       tracer,
+		Type:         infoapi.InstanceType_SERVER,
+	})
+	if healthServer == nil {
+		log.Info().Msg("GRPC HealthCheck GitstafetteServer is empty, running service with normal GRPC GitstafetteServer")
+		grpc_health_v1.RegisterHealthServer(grpcServer, &grpc_internal.HealthCheckService{})
+	} else {
+		log.Printf("Running GRPC HealthCheck GitstafetteServer standalone: %v\n", grpcServer.GetServiceInfo())
+	}
+	return grpcServer
+}
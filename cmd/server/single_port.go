@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/joostvdg/gitstafette/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+)
+
+// initializeSinglePortServer serves the webhook API and all GRPC services on one port, telling GRPC apart by its HTTP/2 content-type.
+// Without TLS, HTTP/2 is accepted in cleartext (h2c), as GRPC clients and Cloud Run use it.
+func initializeSinglePortServer(port string, tlsConfig *tls.Config, grpcServer *grpc.Server, echoServer *echo.Echo) *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPCRequest(r) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		echoServer.ServeHTTP(w, r)
+	})
+
+	singlePortServer := &http.Server{
+		Addr:              ":" + port,
+		Handler:           h2c.NewHandler(handler, &http2.Server{}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if tlsConfig != nil {
+		clientAuth := tlsConfig.ClientAuth
+		if clientAuth == tls.RequireAndVerifyClientCert {
+			// webhook callers have no client certificate, so on a shared port GRPC clients present theirs voluntarily,
+			// main only allows this when GRPC clients are authenticated otherwise
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
+		singlePortServer.Handler = handler
+		singlePortServer.TLSConfig = config.WithClientAuth(tlsConfig, clientAuth)
+	}
+
+	go func() {
+		var err error
+		if singlePortServer.TLSConfig != nil {
+			err = singlePortServer.ListenAndServeTLS("", "")
+		} else {
+			err = singlePortServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Could not start the single port GitstafetteServer")
+		}
+	}()
+	log.Info().Msgf("Serving the webhook API and GRPC on port %v", port)
+	return singlePortServer
+}
+
+// isGRPCRequest matches application/grpc and application/grpc+proto, but not gRPC-Web which the webhook server handles
+func isGRPCRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return r.ProtoMajor == 2 && (contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;"))
+}
@@ -0,0 +1,73 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/joostvdg/gitstafette/internal/auth"
+	"github.com/joostvdg/gitstafette/internal/cache"
+	gcontext "github.com/joostvdg/gitstafette/internal/context"
+	"github.com/labstack/echo/v4"
+)
+
+// authorize authenticates the caller like the GRPC API does, with a bearer token or else a verified client certificate,
+// and checks if it may act as the client with the permission on the repository
+func authorize(ctx echo.Context, permission auth.Permission, clientId string, repositoryId string) (*auth.Identity, error) {
+	webContext, ok := ctx.(*gcontext.GitstafetteContext)
+	if !ok || !webContext.Authorizer.Enabled() {
+		return nil, nil
+	}
+	authorizer := webContext.Authorizer
+
+	var identity *auth.Identity
+	var err error
+	request := ctx.Request()
+	token := strings.TrimPrefix(request.Header.Get(echo.HeaderAuthorization), "Bearer ")
+	switch {
+	case token != "":
+		identity, err = authorizer.AuthenticateToken(token)
+	case authorizer.CertificateIdentityEnabled() && request.TLS != nil && len(request.TLS.VerifiedChains) > 0:
+		identity, err = authorizer.AuthenticateCertificate(request.TLS.VerifiedChains[0][0])
+	default:
+		err = fmt.Errorf("%w: missing authorization header", auth.ErrUnauthenticated)
+	}
+	if err == nil {
+		err = authorizer.Authorize(identity, permission, clientId, repositoryId)
+	}
+	if err != nil {
+		sublogger.Warn().Str("path", request.URL.Path).Str("peer", ctx.RealIP()).Err(err).Msg("Rejected HTTP request")
+		return nil, err
+	}
+	return identity, nil
+}
+
+// authorizeRequired is like authorize, but also refuses the request when the server authenticates no clients, for
+// endpoints that must never be open to anyone
+func authorizeRequired(ctx echo.Context, permission auth.Permission, clientId string, repositoryId string) (*auth.Identity, error) {
+	webContext, ok := ctx.(*gcontext.GitstafetteContext)
+	if !ok || !webContext.Authorizer.Enabled() {
+		return nil, fmt.Errorf("%w: the server has no client credentials configured", auth.ErrUnauthenticated)
+	}
+	return authorize(ctx, permission, clientId, repositoryId)
+}
+
+// repositoryParam returns the ID of the repository in the path, which may also be given by its URL encoded full name
+func repositoryParam(ctx echo.Context) string {
+	repository, err := url.PathUnescape(ctx.Param("repo"))
+	if err != nil {
+		return ""
+	}
+	return cache.ResolveRepositoryID(repository)
+}
+
+// authorizationFailed responds to an error of authorize
+func authorizationFailed(ctx echo.Context, err error) error {
+	status := http.StatusUnauthorized
+	if errors.Is(err, auth.ErrPermissionDenied) {
+		status = http.StatusForbidden
+	}
+	return ctx.JSON(status, map[string]string{"message": err.Error()})
+}
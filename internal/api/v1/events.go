@@ -6,37 +6,172 @@ import (
 	"encoding/hex"
 	"fmt"
 	v1 "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/auth"
 	"github.com/joostvdg/gitstafette/internal/cache"
 	"github.com/labstack/echo/v4"
 
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 )
 
-// WatchedRepositoryList simple type for returning proper JSON
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+	// maxEventsWait bounds how long a request waits for events, to stay below common proxy timeouts
+	maxEventsWait = time.Second * 60
+)
+
+// RepositoryEvents simple type for returning proper JSON, Cursor is the sequence to request the next events after
 type RepositoryEvents struct {
 	Events []*v1.WebhookEventInternal
+	Cursor uint64
 }
 
-// TODO add other CRUD methods
+// EventsAcknowledgement confirms the consumer processed events, either the listed ones or every event up to the cursor
+type EventsAcknowledgement struct {
+	ClientId string   `json:"clientId"`
+	EventIds []string `json:"eventIds"`
+	Cursor   uint64   `json:"cursor"`
+}
 
-// HandleRetrieveEventsForRepository handles API call for listing wich repositories are currently watched
+// HandleRetrieveEventsForRepository lets consumers pull the events of a repository. Without "after" it returns the
+// events not yet acknowledged, otherwise the events after that cursor, at most "limit" of them. With "wait" (in seconds)
+// the request holds until there are events or the time is up. Events stay pending until acknowledged via
+// HandleAcknowledgeEvents.
 func HandleRetrieveEventsForRepository(ctx echo.Context) error {
-	repositoryID := ctx.Param("repo")
+	repositoryID := repositoryParam(ctx)
 
 	if repositoryID == "" {
 		return ctx.String(http.StatusBadRequest, "This request requires a valid RepositoryID")
 	}
+	if cache.IsRepositoryPattern(repositoryID) {
+		return ctx.String(http.StatusBadRequest, "Repository patterns are only supported when fetching events over GRPC")
+	}
+	if _, err := authorizeRequired(ctx, auth.PermissionFetch, ctx.QueryParam("clientId"), repositoryID); err != nil {
+		return authorizationFailed(ctx, err)
+	}
+	if !cache.Repositories.RepositoryIsWatched(repositoryID) {
+		return ctx.String(http.StatusNotFound, fmt.Sprintf("Target %v is not a watched repository", repositoryID))
+	}
 
-	events := cache.Store.RetrieveEventsForRepository(repositoryID)
-	eventList := RepositoryEvents{events}
-	return ctx.JSON(http.StatusOK, eventList)
+	cursor, err := parseCursor(ctx.QueryParam("after"))
+	if err != nil {
+		return ctx.String(http.StatusBadRequest, err.Error())
+	}
+	limit := defaultEventsLimit
+	if value := ctx.QueryParam("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return ctx.String(http.StatusBadRequest, "The limit must be a positive number")
+		}
+		limit = min(limit, maxEventsLimit)
+	}
+	var wait time.Duration
+	if value := ctx.QueryParam("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return ctx.String(http.StatusBadRequest, "The wait must be a number of seconds")
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxEventsWait)
+	}
+
+	cache.Registrations.Touch(repositoryID)
+	// subscribed before looking, so an event stored in between still wakes the request
+	subscription := cache.Notifier.Subscribe([]string{repositoryID})
+	defer subscription.Close()
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		events := eventsAfter(repositoryID, cursor, limit)
+		if len(events) > 0 {
+			return ctx.JSON(http.StatusOK, RepositoryEvents{events, events[len(events)-1].Sequence})
+		}
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case <-deadline.C:
+			return ctx.JSON(http.StatusOK, RepositoryEvents{events, cursor})
+		case <-subscription.C:
+		}
+	}
+}
+
+// eventsAfter returns the pending events after the cursor in order of their sequence, at most limit of them
+func eventsAfter(repositoryID string, cursor uint64, limit int) []*v1.WebhookEventInternal {
+	pending, _ := cache.PendingEvents(repositoryID, cursor)
+	events := make([]*v1.WebhookEventInternal, 0, len(pending))
+	for _, event := range pending {
+		if event.Sequence > cursor {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// HandleAcknowledgeEvents marks the events a consumer processed as relayed, so they are no longer pending
+func HandleAcknowledgeEvents(ctx echo.Context) error {
+	repositoryID := repositoryParam(ctx)
+	if repositoryID == "" {
+		return ctx.String(http.StatusBadRequest, "This request requires a valid RepositoryID")
+	}
+	if cache.IsRepositoryPattern(repositoryID) {
+		return ctx.String(http.StatusBadRequest, "Repository patterns are only supported when fetching events over GRPC")
+	}
+	acknowledgement := new(EventsAcknowledgement)
+	if err := ctx.Bind(acknowledgement); err != nil {
+		return ctx.String(http.StatusBadRequest, "Could not read the acknowledgement")
+	}
+	if len(acknowledgement.EventIds) == 0 && acknowledgement.Cursor == 0 {
+		return ctx.String(http.StatusBadRequest, "The acknowledgement requires eventIds or a cursor")
+	}
+	if _, err := authorizeRequired(ctx, auth.PermissionFetch, acknowledgement.ClientId, repositoryID); err != nil {
+		return authorizationFailed(ctx, err)
+	}
+	if !cache.Repositories.RepositoryIsWatched(repositoryID) {
+		return ctx.String(http.StatusNotFound, fmt.Sprintf("Target %v is not a watched repository", repositoryID))
+	}
+
+	eventIds := acknowledgement.EventIds
+	if acknowledgement.Cursor > 0 {
+		for _, event := range cache.Store.RetrieveEventsForRepository(repositoryID) {
+			if !event.IsRelayed && event.Sequence <= acknowledgement.Cursor {
+				eventIds = append(eventIds, event.ID)
+			}
+		}
+	}
+	acknowledged := 0
+	for _, eventId := range eventIds {
+		if cache.Store.MarkRelayed(repositoryID, eventId) {
+			acknowledged++
+		}
+	}
+	sublogger.Info().Msgf("Acknowledged %d events for repository %v", acknowledged, repositoryID)
+	return ctx.JSON(http.StatusOK, map[string]int{"acknowledged": acknowledged})
+}
+
+// parseCursor reads the sequence of an event to resume after, an empty value starts at the pending events
+func parseCursor(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("the event id to resume after must be a sequence number")
+	}
+	return cursor, nil
 }
 
 func ValidateEvent(hmac string, event *v1.WebhookEvent) bool {
 	digestHeader := ""
 	for _, header := range event.Headers {
-		if header.Name == SignatureHeader {
-			digestHeader = header.Values
+		if http.CanonicalHeaderKey(header.Name) == SignatureHeader && len(header.Values) > 0 {
+			digestHeader = header.Values[0]
 		}
 	}
 	if digestHeader == "" {
@@ -9,6 +9,7 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	sentryecho "github.com/getsentry/sentry-go/echo"
+	v1 "github.com/joostvdg/gitstafette/api/v1"
 	"github.com/joostvdg/gitstafette/internal/cache"
 	gcontext "github.com/joostvdg/gitstafette/internal/context"
 	"github.com/labstack/echo/v4"
@@ -31,10 +32,24 @@ func HandleGitHubPost(ctx echo.Context) error {
 			log.Warn().Err(err).Msg("Could not close body")
 		}
 	}(body)
-	messagePayload, err := io.ReadAll(body)
+	webContext := ctx.(*gcontext.GitstafetteContext)
+	maxPayloadSize := webContext.MaxPayloadSize
+	if maxPayloadSize > 0 && ctx.Request().ContentLength > maxPayloadSize {
+		return payloadTooLarge(ctx, ctx.Request().ContentLength, maxPayloadSize)
+	}
+
+	var payloadReader io.Reader = body
+	if maxPayloadSize > 0 {
+		// read one byte more than allowed, so we can tell if the body was too large
+		payloadReader = io.LimitReader(body, maxPayloadSize+1)
+	}
+	messagePayload, err := io.ReadAll(payloadReader)
 	if err != nil {
 		sublogger.Warn().Err(err).Msg("Ran into an error parsing content (Assumed GitHub Post)")
 	}
+	if maxPayloadSize > 0 && int64(len(messagePayload)) > maxPayloadSize {
+		return payloadTooLarge(ctx, int64(len(messagePayload)), maxPayloadSize)
+	}
 
 	headers := ctx.Request().Header
 	targetType := headers[TargetTypeHeader]
@@ -42,8 +57,7 @@ func HandleGitHubPost(ctx echo.Context) error {
 		return ctx.String(http.StatusNotAcceptable, "InternalEvent is not for a repository")
 	}
 
-	// TODO validate message via webhook token & sha256 hash
-	webContext := ctx.(*gcontext.GitstafetteContext)
+	verified := false
 	if webContext.WebhookHMAC != "" {
 		digestHeader := ""
 		if len(headers[SignatureHeader]) > 0 && headers[SignatureHeader][0] != "" {
@@ -64,17 +78,26 @@ func HandleGitHubPost(ctx echo.Context) error {
 			}
 			return ctx.String(http.StatusBadRequest, message)
 		}
+		verified = true
 	} else {
-		sublogger.Warn().Msg("No HMAC set, ignoring digest")
+		sublogger.Warn().Msg("No HMAC set, ignoring digest and not learning the repository name")
 	}
 
 	targetRepositoryID := headers[TargetIdHeader][0]
+	if verified {
+		// names decide which repositories are watched and which clients may access them, so anyone sending webhooks
+		// must not choose them
+		cache.LearnRepositoryName(targetRepositoryID, v1.PayloadRepositoryFullName(messagePayload, headers.Get(echo.HeaderContentType)))
+	}
 	isStored := false
 	if cache.Repositories.RepositoryIsWatched(targetRepositoryID) {
-		// TODO handle error
-		isStored, _ = cache.InternalEvent(targetRepositoryID, messagePayload, headers)
+		isStored, err = cache.InternalEvent(targetRepositoryID, messagePayload, headers)
+		if err != nil {
+			sublogger.Warn().Err(err).Msg("Could not cache repository event")
+			return ctx.String(http.StatusInternalServerError, "Could not cache repository event")
+		}
 	} else {
-		message := fmt.Sprintf("Target %v is not a watched repository", targetRepositoryID)
+		message := fmt.Sprintf("Target %v is not a watched repository", cache.DescribeRepository(targetRepositoryID))
 		sublogger.Warn().Msg(message)
 		if hub := sentryecho.GetHubFromContext(ctx); hub != nil {
 			hub.WithScope(func(scope *sentry.Scope) {
@@ -92,3 +115,9 @@ func HandleGitHubPost(ctx echo.Context) error {
 	}
 	return ctx.String(http.StatusNoContent, "Repository event accepted but is already cached")
 }
+
+func payloadTooLarge(ctx echo.Context, payloadSize int64, maxPayloadSize int64) error {
+	message := fmt.Sprintf("Payload of %d bytes exceeds the maximum of %d bytes", payloadSize, maxPayloadSize)
+	sublogger.Warn().Msg(message)
+	return ctx.String(http.StatusRequestEntityTooLarge, message)
+}
@@ -0,0 +1,227 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	api "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/auth"
+	"github.com/joostvdg/gitstafette/internal/cache"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// heartbeatInterval is how long a stream waits without events before sending a heartbeat, matching the GRPC stream
+	heartbeatInterval = time.Second * 5
+
+	streamEventWebhook = "webhook"
+	streamEventRelayed = "relayed"
+)
+
+// accessTokenParameter carries the token for clients that cannot set headers, such as a browser's EventSource. Only
+// streams accept it, and the request log leaves out the query so it does not keep the token.
+const accessTokenParameter = "access_token"
+
+var upgrader = websocket.Upgrader{}
+
+// streamMessage is a WebSocket message, the same content an SSE event carries in its event, id, and data fields
+type streamMessage struct {
+	Type     string          `json:"type"`
+	Sequence uint64          `json:"sequence,omitempty"`
+	Event    json.RawMessage `json:"event,omitempty"`
+	EventIds []string        `json:"eventIds,omitempty"`
+}
+
+// relayStatus tells the consumer which events are now marked as relayed, and the cursor to resume after them
+type relayStatus struct {
+	EventIds []string `json:"eventIds"`
+	Cursor   uint64   `json:"cursor"`
+}
+
+// streamWriter sends the events of a repository to a consumer, over SSE or a WebSocket
+type streamWriter interface {
+	event(sequence uint64, event []byte) error
+	relayed(status relayStatus) error
+	heartbeat() error
+}
+
+// HandleEventStream streams the events of a repository like the GRPC FetchWebhookEvents does, as Server-Sent Events,
+// or as JSON messages when the request upgrades to a WebSocket. The stream resumes after the Last-Event-ID header or
+// the "after" parameter, and runs until the consumer disconnects or the server stops.
+func HandleEventStream(ctx echo.Context) error {
+	repositoryID := repositoryParam(ctx)
+	if repositoryID == "" {
+		return ctx.String(http.StatusBadRequest, "This request requires a valid RepositoryID")
+	}
+	if cache.IsRepositoryPattern(repositoryID) {
+		return ctx.String(http.StatusBadRequest, "Repository patterns are only supported when fetching events over GRPC")
+	}
+	clientID := ctx.QueryParam("clientId")
+	if token := ctx.QueryParam(accessTokenParameter); token != "" && ctx.Request().Header.Get(echo.HeaderAuthorization) == "" {
+		ctx.Request().Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	if _, err := authorizeRequired(ctx, auth.PermissionFetch, clientID, repositoryID); err != nil {
+		return authorizationFailed(ctx, err)
+	}
+	if !cache.Repositories.RepositoryIsWatched(repositoryID) {
+		return ctx.String(http.StatusNotFound, fmt.Sprintf("Target %v is not a watched repository", repositoryID))
+	}
+
+	lastEventID := ctx.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = ctx.QueryParam("after")
+	}
+	cursor, err := parseCursor(lastEventID)
+	if err != nil {
+		return ctx.String(http.StatusBadRequest, err.Error())
+	}
+
+	if websocket.IsWebSocketUpgrade(ctx.Request()) {
+		connection, err := upgrader.Upgrade(ctx.Response(), ctx.Request(), nil)
+		if err != nil {
+			// the upgrader already responded
+			sublogger.Warn().Err(err).Msg("Could not upgrade to a WebSocket")
+			return nil
+		}
+		defer connection.Close()
+		closed := make(chan struct{})
+		go func() {
+			// the consumer sends nothing, reading only handles control messages and notices when it goes away
+			defer close(closed)
+			for {
+				if _, _, err := connection.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		sublogger.Info().Msgf("Streaming events for repository %v over a WebSocket to %v", repositoryID, ctx.RealIP())
+		streamEvents(&webSocketWriter{connection}, repositoryID, cursor, closed)
+		connection.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+		return nil
+	}
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	// proxies such as NGINX otherwise buffer the stream
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+	sublogger.Info().Msgf("Streaming events for repository %v as Server-Sent Events to %v", repositoryID, ctx.RealIP())
+	streamEvents(&sseWriter{response}, repositoryID, cursor, ctx.Request().Context().Done())
+	return nil
+}
+
+func streamEvents(writer streamWriter, repositoryID string, cursor uint64, done <-chan struct{}) {
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	subscription := cache.Notifier.Subscribe([]string{repositoryID})
+	defer subscription.Close()
+	heartbeat := time.NewTimer(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	idle := false
+	for {
+		cache.Registrations.Touch(repositoryID)
+		events, nextCursor := cache.PendingEvents(repositoryID, cursor)
+		status := relayStatus{EventIds: make([]string, 0, len(events))}
+		for _, cachedEvent := range events {
+			event, err := protojson.Marshal(api.InternalToExternalEvent(cachedEvent))
+			if err != nil {
+				sublogger.Warn().Err(err).Str("repo", repositoryID).Msg("Could not encode event for the stream")
+				continue
+			}
+			if err := writer.event(cachedEvent.Sequence, event); err != nil {
+				sublogger.Info().Err(err).Str("repo", repositoryID).Msg("Stream closed")
+				return
+			}
+			cache.Store.MarkRelayed(repositoryID, cachedEvent.ID)
+			status.EventIds = append(status.EventIds, cachedEvent.ID)
+		}
+		cursor = nextCursor
+
+		var err error
+		if len(status.EventIds) > 0 {
+			status.Cursor = cursor
+			err = writer.relayed(status)
+			heartbeat.Reset(heartbeatInterval)
+		} else if idle {
+			err = writer.heartbeat()
+		}
+		if err != nil {
+			sublogger.Info().Err(err).Str("repo", repositoryID).Msg("Stream closed")
+			return
+		}
+
+		select {
+		case <-done:
+			sublogger.Info().Str("repo", repositoryID).Msg("Stream closed by the consumer")
+			return
+		case <-stopped.Done():
+			sublogger.Info().Str("repo", repositoryID).Msg("Server stopping, closing stream")
+			return
+		case <-subscription.C:
+			idle = false
+		case <-heartbeat.C:
+			idle = true
+			heartbeat.Reset(heartbeatInterval)
+		}
+	}
+}
+
+type sseWriter struct {
+	response *echo.Response
+}
+
+func (w *sseWriter) event(sequence uint64, event []byte) error {
+	if _, err := fmt.Fprintf(w.response, "id: %d\nevent: %s\ndata: %s\n\n", sequence, streamEventWebhook, event); err != nil {
+		return err
+	}
+	w.response.Flush()
+	return nil
+}
+
+func (w *sseWriter) relayed(status relayStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.response, "event: %s\ndata: %s\n\n", streamEventRelayed, data); err != nil {
+		return err
+	}
+	w.response.Flush()
+	return nil
+}
+
+func (w *sseWriter) heartbeat() error {
+	// a comment, which keeps idle connections open through proxies without dispatching an event
+	if _, err := fmt.Fprint(w.response, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	w.response.Flush()
+	return nil
+}
+
+type webSocketWriter struct {
+	connection *websocket.Conn
+}
+
+func (w *webSocketWriter) event(sequence uint64, event []byte) error {
+	return w.connection.WriteJSON(streamMessage{Type: streamEventWebhook, Sequence: sequence, Event: event})
+}
+
+func (w *webSocketWriter) relayed(status relayStatus) error {
+	return w.connection.WriteJSON(streamMessage{Type: streamEventRelayed, Sequence: status.Cursor, EventIds: status.EventIds})
+}
+
+func (w *webSocketWriter) heartbeat() error {
+	return w.connection.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+}
@@ -1,23 +1,99 @@
 package v1
 
 import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/joostvdg/gitstafette/internal/auth"
 	"github.com/joostvdg/gitstafette/internal/cache"
+	gcontext "github.com/joostvdg/gitstafette/internal/context"
 	"github.com/labstack/echo/v4"
-	"net/http"
 )
 
 // WatchedRepositoryList simple type for returning proper JSON
 type WatchedRepositoryList struct {
 	GitHubRepositoryIDs []string
+	Repositories        []WatchedRepository
 }
 
-// TODO add other CRUD methods
+// WatchedRepository is a watched repository with its full name, once learned from a webhook
+type WatchedRepository struct {
+	ID   string `json:",omitempty"`
+	Name string `json:",omitempty"`
+}
 
 // HandleWatchListGet handles API call for listing wich repositories are currently watched
 func HandleWatchListGet(ctx echo.Context) error {
 
-	repoIds := cache.Repositories.Repositories
-	list := WatchedRepositoryList{repoIds}
+	repoIds := cache.Repositories.WatchedRepositories()
+	repositories := make([]WatchedRepository, 0, len(repoIds))
+	for _, repoId := range repoIds {
+		repository := WatchedRepository{ID: repoId}
+		if cache.IsRepositoryName(repoId) {
+			// not seen in a webhook yet, so the ID is unknown
+			repository = WatchedRepository{Name: repoId}
+		} else if name, ok := cache.Names.Name(repoId); ok {
+			repository.Name = name
+		}
+		repositories = append(repositories, repository)
+	}
+	list := WatchedRepositoryList{repoIds, repositories}
 
 	return ctx.JSON(http.StatusOK, list)
 }
+
+// HandleWatchListPost starts watching a repository, which requires the push permission for it
+func HandleWatchListPost(ctx echo.Context) error {
+	repositoryID := repositoryParam(ctx)
+	if repositoryID == "" {
+		return ctx.String(http.StatusBadRequest, "This request requires a valid RepositoryID")
+	}
+	if _, err := authorizeRequired(ctx, auth.PermissionPush, ctx.QueryParam("clientId"), repositoryID); err != nil {
+		return authorizationFailed(ctx, err)
+	}
+	isName := cache.IsRepositoryName(repositoryID) || cache.IsRepositoryPattern(repositoryID)
+	if isName && ctx.(*gcontext.GitstafetteContext).WebhookHMAC == "" {
+		// names are only learned from verified webhooks, so the repository would never receive events
+		return ctx.String(http.StatusBadRequest, "Watching repositories by name or pattern requires the server to verify webhooks")
+	}
+
+	if !cache.Repositories.AddRepository(repositoryID) {
+		if cache.Repositories.RepositoryIsWatched(repositoryID) {
+			return ctx.String(http.StatusOK, fmt.Sprintf("Repository %v is already watched", repositoryID))
+		}
+		return ctx.String(http.StatusInternalServerError, fmt.Sprintf("Could not watch repository %v", repositoryID))
+	}
+	sublogger.Info().Msgf("Now watching repository %v", repositoryID)
+	return ctx.String(http.StatusCreated, fmt.Sprintf("Repository %v is now watched", repositoryID))
+}
+
+// HandleWatchListDelete stops watching a repository, with "purge" also removing its cached events.
+// Like adding a repository, this requires the push permission for it.
+func HandleWatchListDelete(ctx echo.Context) error {
+	repositoryID := repositoryParam(ctx)
+	if repositoryID == "" {
+		return ctx.String(http.StatusBadRequest, "This request requires a valid RepositoryID")
+	}
+	purge := false
+	if value := ctx.QueryParam("purge"); value != "" {
+		var err error
+		purge, err = strconv.ParseBool(value)
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, "Purge must be true or false")
+		}
+	}
+	if _, err := authorizeRequired(ctx, auth.PermissionPush, ctx.QueryParam("clientId"), repositoryID); err != nil {
+		return authorizationFailed(ctx, err)
+	}
+
+	if !cache.Repositories.RemoveRepository(repositoryID) {
+		return ctx.String(http.StatusNotFound, fmt.Sprintf("Target %v is not a watched repository", repositoryID))
+	}
+	message := fmt.Sprintf("Repository %v is no longer watched", repositoryID)
+	if purge {
+		message = fmt.Sprintf("%v, purged %d cached events", message, cache.PurgeEvents(repositoryID))
+	}
+	sublogger.Info().Msg(message)
+	return ctx.String(http.StatusOK, message)
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type Permission string
+
+const (
+	// PermissionFetch allows receiving the events of a repository
+	PermissionFetch Permission = "fetch"
+	// PermissionPush allows sending events for a repository
+	PermissionPush Permission = "push"
+
+	// AnyRepository in an access list grants the permission for every repository
+	AnyRepository = "*"
+)
+
+var (
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+var sublogger zerolog.Logger
+
+func init() {
+	sublogger = log.With().Str("component", "auth").Logger()
+}
+
+// Client is a single client credential, bound to a client id, with the repositories it may access.
+// Clients authenticating with a JWT need no token, their entry only adds to the repositories from the token.
+type Client struct {
+	ClientID string   `json:"clientId"`
+	Token    string   `json:"token,omitempty"`
+	Fetch    []string `json:"fetch"`
+	Push     []string `json:"push"`
+}
+
+// Credentials is the format of the client credentials file
+type Credentials struct {
+	Clients []*Client `json:"clients"`
+}
+
+// Identity is an authenticated caller
+type Identity struct {
+	// ClientID the caller is bound to, empty if the credential may be used with any client id
+	ClientID string
+	// Method describes how the caller was authenticated
+	Method string
+	Fetch  []string
+	Push   []string
+}
+
+func (i *Identity) String() string {
+	clientId := i.ClientID
+	if clientId == "" {
+		clientId = "<any>"
+	}
+	return fmt.Sprintf("%s (%s)", clientId, i.Method)
+}
+
+// Authorizer authenticates callers and checks their access to repositories
+type Authorizer struct {
+	clients      []*Client
+	jwt          *jwtValidator
+	certificates bool
+	// aliases returns the other names of a repository, so access lists may use either its ID or its full name
+	aliases func(repositoryId string) []string
+}
+
+// NewAuthorizer creates an Authorizer for the given clients, and validating JWTs if jwtConfig is set.
+// Without either, every request is allowed.
+func NewAuthorizer(clients []*Client, jwtConfig *JWTConfig) (*Authorizer, error) {
+	authorizer := &Authorizer{clients: clients}
+	if jwtConfig != nil {
+		validator, err := newJWTValidator(jwtConfig)
+		if err != nil {
+			return nil, err
+		}
+		authorizer.jwt = validator
+	}
+	return authorizer, nil
+}
+
+// LoadAuthorizer reads the client credentials file, if any, and adds the legacy shared token as a credential for every repository
+func LoadAuthorizer(credentialsFileLocation string, legacyToken string, jwtConfig *JWTConfig) (*Authorizer, error) {
+	clients := make([]*Client, 0)
+	if credentialsFileLocation != "" {
+		content, err := os.ReadFile(credentialsFileLocation)
+		if err != nil {
+			return nil, err
+		}
+		var credentials Credentials
+		if err := json.Unmarshal(content, &credentials); err != nil {
+			return nil, fmt.Errorf("invalid client credentials file %q: %w", credentialsFileLocation, err)
+		}
+		for _, client := range credentials.Clients {
+			if client.ClientID == "" {
+				return nil, fmt.Errorf("invalid client credentials file %q: every client requires a clientId", credentialsFileLocation)
+			}
+		}
+		clients = append(clients, credentials.Clients...)
+	}
+	if legacyToken != "" {
+		clients = append(clients, &Client{
+			Token: legacyToken,
+			Fetch: []string{AnyRepository},
+			Push:  []string{AnyRepository},
+		})
+	}
+
+	authorizer, err := NewAuthorizer(clients, jwtConfig)
+	if err != nil {
+		return nil, err
+	}
+	if authorizer.Enabled() {
+		sublogger.Info().Msgf("Authentication enabled for %d client credentials", len(clients))
+	} else {
+		sublogger.Warn().Msg("No client credentials configured, authentication is disabled")
+	}
+	return authorizer, nil
+}
+
+// Enabled is false when no credentials are configured, in which case every request is allowed
+func (a *Authorizer) Enabled() bool {
+	return a != nil && (len(a.clients) > 0 || a.jwt != nil || a.certificates)
+}
+
+// AuthenticateToken returns the identity belonging to a bearer token, which is either a JWT or a static token
+func (a *Authorizer) AuthenticateToken(token string) (*Identity, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: no token provided", ErrUnauthenticated)
+	}
+	for _, client := range a.clients {
+		if client.Token != "" && subtle.ConstantTimeCompare([]byte(client.Token), []byte(token)) == 1 {
+			return client.identity("token"), nil
+		}
+	}
+	if a.jwt != nil && isJWT(token) {
+		return a.authenticateJWT(token)
+	}
+	return nil, fmt.Errorf("%w: token is not valid", ErrUnauthenticated)
+}
+
+func (a *Authorizer) authenticateJWT(token string) (*Identity, error) {
+	claims, err := a.jwt.validate(token)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := a.jwt.identity(claims)
+	if err != nil {
+		return nil, err
+	}
+	// the credentials file can grant a JWT client additional repositories
+	if client, ok := a.client(identity.ClientID); ok {
+		identity.Fetch = append(identity.Fetch, client.Fetch...)
+		identity.Push = append(identity.Push, client.Push...)
+	}
+	return identity, nil
+}
+
+func (a *Authorizer) client(clientId string) (*Client, bool) {
+	for _, client := range a.clients {
+		if client.ClientID == clientId {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// ResolveRepositoriesWith makes access lists match any of the aliases of a repository
+func (a *Authorizer) ResolveRepositoriesWith(aliases func(repositoryId string) []string) {
+	a.aliases = aliases
+}
+
+// Authorize checks if the identity may act as clientId with the permission on the repository.
+// An empty repositoryId only checks the client id.
+func (a *Authorizer) Authorize(identity *Identity, permission Permission, clientId string, repositoryId string) error {
+	if !a.Enabled() {
+		return nil
+	}
+	if identity == nil {
+		return fmt.Errorf("%w: no identity", ErrUnauthenticated)
+	}
+	if identity.ClientID != "" && clientId != "" && identity.ClientID != clientId {
+		return fmt.Errorf("%w: %v may not act as client %v", ErrPermissionDenied, identity, clientId)
+	}
+	if repositoryId == "" {
+		return nil
+	}
+
+	var repositories []string
+	switch permission {
+	case PermissionFetch:
+		repositories = identity.Fetch
+	case PermissionPush:
+		repositories = identity.Push
+	}
+	if slices.Contains(repositories, AnyRepository) {
+		return nil
+	}
+	aliases := []string{repositoryId}
+	if a.aliases != nil {
+		aliases = a.aliases(repositoryId)
+	}
+	allowed := func(alias string) bool {
+		return slices.ContainsFunc(repositories, func(repository string) bool { return repositoryMatches(repository, alias) })
+	}
+	if !slices.ContainsFunc(aliases, allowed) {
+		return fmt.Errorf("%w: %v may not %s repository %v", ErrPermissionDenied, identity, permission, repositoryId)
+	}
+	return nil
+}
+
+func (c *Client) identity(method string) *Identity {
+	return &Identity{
+		ClientID: c.ClientID,
+		Method:   method,
+		Fetch:    c.Fetch,
+		Push:     c.Push,
+	}
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns a context carrying the authenticated identity
+func ContextWithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the authenticated identity, if any
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// repositoryMatches tells if an access list entry grants the repository, either naming it or as a pattern (owner/*)
+// matching its full name. Like on GitHub, names are case-insensitive. A requested pattern is only granted by the same
+// pattern, as a narrower one could match it literally, myorg/app? matches myorg/app* for instance.
+func repositoryMatches(entry string, repository string) bool {
+	if strings.EqualFold(entry, repository) {
+		return true
+	}
+	if !strings.ContainsAny(entry, "*?[") || strings.ContainsAny(repository, "*?[") {
+		return false
+	}
+	matched, err := path.Match(strings.ToLower(entry), strings.ToLower(repository))
+	return err == nil && matched
+}
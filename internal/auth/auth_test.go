@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthorizeRepositoryPatterns(t *testing.T) {
+	authorizer, err := NewAuthorizer([]*Client{{ClientID: "static", Token: "static-token"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{"1": "myorg/app1", "2": "myorg/app10", "3": "otherorg/app1"}
+	authorizer.ResolveRepositoriesWith(func(repositoryId string) []string {
+		if name, ok := names[repositoryId]; ok {
+			return []string{repositoryId, name}
+		}
+		return []string{repositoryId}
+	})
+
+	tests := []struct {
+		name       string
+		fetch      []string
+		repository string
+		allowed    bool
+	}{
+		{name: "pattern grants a matching name", fetch: []string{"myorg/app?"}, repository: "myorg/app1", allowed: true},
+		{name: "pattern grants a matching id", fetch: []string{"myorg/app?"}, repository: "1", allowed: true},
+		{name: "pattern does not grant other names", fetch: []string{"myorg/app?"}, repository: "2"},
+		{name: "pattern does not grant other owners", fetch: []string{"myorg/*"}, repository: "3"},
+		{name: "pattern does not grant a wider pattern", fetch: []string{"myorg/app?"}, repository: "myorg/app*"},
+		{name: "pattern does not grant a bracket pattern", fetch: []string{"myorg/app?"}, repository: "myorg/app[0-9]"},
+		{name: "pattern grants the same pattern", fetch: []string{"myorg/app*"}, repository: "MyOrg/App*", allowed: true},
+		{name: "any repository grants a pattern", fetch: []string{AnyRepository}, repository: "myorg/*", allowed: true},
+		{name: "name does not grant a pattern", fetch: []string{"myorg/app1"}, repository: "myorg/app?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := &Identity{ClientID: "client-1", Method: "token", Fetch: tt.fetch}
+			err := authorizer.Authorize(identity, PermissionFetch, "client-1", tt.repository)
+			if tt.allowed && err != nil {
+				t.Errorf("Authorize(%v) error = %v, want allowed", tt.repository, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("Authorize(%v) error = %v, want %v", tt.repository, err, ErrPermissionDenied)
+			}
+		})
+	}
+}
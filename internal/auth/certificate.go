@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+const spiffeScheme = "spiffe"
+
+// EnableCertificateIdentity makes callers without a token authenticate with their verified TLS client certificate,
+// the certificate's SPIFFE ID, common name or DNS name is their client id
+func (a *Authorizer) EnableCertificateIdentity() {
+	a.certificates = true
+	sublogger.Info().Msg("Client certificates identify GRPC clients without a token")
+}
+
+// CertificateIdentityEnabled tells if callers may authenticate with a TLS client certificate
+func (a *Authorizer) CertificateIdentityEnabled() bool {
+	return a != nil && a.certificates
+}
+
+// AuthenticateCertificate returns the identity belonging to a verified client certificate,
+// with the repositories granted to its client id in the credentials file
+func (a *Authorizer) AuthenticateCertificate(certificate *x509.Certificate) (*Identity, error) {
+	if !a.CertificateIdentityEnabled() {
+		return nil, fmt.Errorf("%w: client certificates are not accepted as identity", ErrUnauthenticated)
+	}
+	if certificate == nil {
+		return nil, fmt.Errorf("%w: no verified client certificate", ErrUnauthenticated)
+	}
+	clientId := CertificateClientID(certificate)
+	if clientId == "" {
+		return nil, fmt.Errorf("%w: client certificate %v has no usable name", ErrUnauthenticated, certificate.SerialNumber)
+	}
+	identity := &Identity{
+		ClientID: clientId,
+		Method:   "mtls",
+	}
+	if client, ok := a.client(clientId); ok {
+		identity.Fetch = client.Fetch
+		identity.Push = client.Push
+	}
+	return identity, nil
+}
+
+// BindCertificate ties a token identity to the verified client certificate of the same connection, so a token cannot
+// be used to act as another client than the certificate names. An identity that may act as any client id is narrowed
+// down to the client id of the certificate.
+func (a *Authorizer) BindCertificate(identity *Identity, certificate *x509.Certificate) (*Identity, error) {
+	if !a.CertificateIdentityEnabled() || certificate == nil {
+		return identity, nil
+	}
+	clientId := CertificateClientID(certificate)
+	if clientId == "" {
+		return nil, fmt.Errorf("%w: client certificate %v has no usable name", ErrUnauthenticated, certificate.SerialNumber)
+	}
+	if identity.ClientID != "" && identity.ClientID != clientId {
+		return nil, fmt.Errorf("%w: %v does not match client certificate %v", ErrPermissionDenied, identity, clientId)
+	}
+	bound := *identity
+	bound.ClientID = clientId
+	return &bound, nil
+}
+
+// CertificateClientID returns the name identifying the holder of the certificate,
+// preferring a SPIFFE ID, then the common name and then the first DNS name
+func CertificateClientID(certificate *x509.Certificate) string {
+	for _, uri := range certificate.URIs {
+		if uri.Scheme == spiffeScheme {
+			return uri.String()
+		}
+	}
+	if certificate.Subject.CommonName != "" {
+		return certificate.Subject.CommonName
+	}
+	if len(certificate.DNSNames) > 0 {
+		return certificate.DNSNames[0]
+	}
+	return ""
+}
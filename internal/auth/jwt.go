@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// the minimum time between fetching a JWKS URL again, when a token is signed with an unknown key
+	jwksRefreshBackoff = 5 * time.Minute
+	// the maximum age of keys fetched from a JWKS URL
+	jwksMaxAge = time.Hour
+	// the allowed clock skew for the time based claims
+	jwtLeeway = 30 * time.Second
+)
+
+var jwtSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JWTConfig configures the validation of JWTs, such as GCP service account identity tokens
+// or Kubernetes projected service account tokens
+type JWTConfig struct {
+	// JWKSLocation is a local file or an http(s) URL with the JSON Web Key Set of the issuer
+	JWKSLocation string
+	Issuer       string
+	Audience     string
+	// ClientIDClaim is the claim holding the client id, for example `sub` or `email`
+	ClientIDClaim string
+	// RepositoriesClaim is the claim holding the repositories the client may fetch, as a list or a space or comma separated string
+	RepositoriesClaim string
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jwtValidator verifies JWTs against the keys of a JWKS, refreshing them when a URL is used
+type jwtValidator struct {
+	config      *JWTConfig
+	httpClient  *http.Client
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+}
+
+func newJWTValidator(config *JWTConfig) (*jwtValidator, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("validating JWTs requires both an issuer and an audience")
+	}
+	if config.ClientIDClaim == "" {
+		return nil, fmt.Errorf("validating JWTs requires a claim for the client id")
+	}
+	validator := &jwtValidator{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	validator.lastRefresh = time.Now()
+	if err := validator.refresh(); err != nil {
+		return nil, err
+	}
+	sublogger.Info().Msgf("Validating JWTs from %v for audience %v with %d keys from %v",
+		config.Issuer, config.Audience, len(validator.keys), config.JWKSLocation)
+	return validator, nil
+}
+
+func (v *jwtValidator) isRemote() bool {
+	return strings.HasPrefix(v.config.JWKSLocation, "https://") || strings.HasPrefix(v.config.JWKSLocation, "http://")
+}
+
+// refresh reloads the keys, reading the file or URL without holding the lock so authentications meanwhile need not
+// wait for it
+func (v *jwtValidator) refresh() error {
+	var content []byte
+	var err error
+	if v.isRemote() {
+		content, err = v.fetch()
+	} else {
+		content, err = os.ReadFile(v.config.JWKSLocation)
+	}
+	if err != nil {
+		return fmt.Errorf("could not load JWKS from %q: %w", v.config.JWKSLocation, err)
+	}
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return fmt.Errorf("could not parse JWKS from %q: %w", v.config.JWKSLocation, err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// claimRefresh tells if the keys from a URL are older than the interval, claiming their refresh so concurrent
+// callers keep using the keys we have rather than fetching them as well
+func (v *jwtValidator) claimRefresh(interval time.Duration) bool {
+	if !v.isRemote() {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.lastRefresh) <= interval {
+		return false
+	}
+	v.lastRefresh = time.Now()
+	return true
+}
+
+func (v *jwtValidator) fetch() ([]byte, error) {
+	response, err := v.httpClient.Get(v.config.JWKSLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 1024*1024))
+}
+
+// key returns the public key for the key id, fetching the JWKS again if it is unknown or stale
+func (v *jwtValidator) key(keyID string) (crypto.PublicKey, error) {
+	if v.claimRefresh(jwksMaxAge) {
+		if err := v.refresh(); err != nil {
+			sublogger.Warn().Err(err).Msg("Could not refresh JWKS, using the keys we have")
+		}
+	}
+	key, found := v.lookup(keyID)
+	if !found && v.claimRefresh(jwksRefreshBackoff) {
+		if err := v.refresh(); err != nil {
+			sublogger.Warn().Err(err).Msg("Could not refresh JWKS")
+		}
+		key, found = v.lookup(keyID)
+	}
+	if !found {
+		return nil, fmt.Errorf("no key found for key id %q", keyID)
+	}
+	return key, nil
+}
+
+func (v *jwtValidator) lookup(keyID string) (crypto.PublicKey, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if keyID == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, found := v.keys[keyID]
+	return key, found
+}
+
+// validate verifies the signature and the issuer, audience and expiry of the token
+func (v *jwtValidator) validate(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		return v.key(keyID)
+	},
+		jwt.WithValidMethods(jwtSigningMethods),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithAudience(v.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid JWT: %v", ErrUnauthenticated, err)
+	}
+	return claims, nil
+}
+
+// identity maps the claims of a validated token to the client id and the repositories it may fetch
+func (v *jwtValidator) identity(claims jwt.MapClaims) (*Identity, error) {
+	clientId, _ := claims[v.config.ClientIDClaim].(string)
+	if clientId == "" {
+		return nil, fmt.Errorf("%w: JWT has no %q claim", ErrUnauthenticated, v.config.ClientIDClaim)
+	}
+	identity := &Identity{
+		ClientID: clientId,
+		Method:   "jwt",
+	}
+	if v.config.RepositoriesClaim != "" {
+		identity.Fetch = claimValues(claims[v.config.RepositoriesClaim])
+	}
+	return identity, nil
+}
+
+// claimValues accepts a list of strings or a space or comma separated string
+func claimValues(claim interface{}) []string {
+	values := make([]string, 0)
+	switch claim := claim.(type) {
+	case string:
+		values = append(values, strings.FieldsFunc(claim, func(r rune) bool {
+			return r == ' ' || r == ','
+		})...)
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok && value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// isJWT tells a JWT apart from an opaque static token, by parsing it without verifying it yet
+func isJWT(token string) bool {
+	_, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	return err == nil
+}
+
+func parseJWKS(content []byte) (map[string]crypto.PublicKey, error) {
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(content, &keySet); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found")
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
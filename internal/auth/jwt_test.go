@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "gitstafette"
+	testKeyID    = "key-1"
+)
+
+// writeJWKS writes a JWKS file holding the public key under the key id
+func writeJWKS(t *testing.T, key *ecdsa.PrivateKey, keyID string) string {
+	t.Helper()
+	size := (key.Curve.Params().BitSize + 7) / 8
+	keySet := jsonWebKeySet{Keys: []jsonWebKey{{
+		KeyType: "EC",
+		KeyID:   keyID,
+		Use:     "sig",
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}}}
+	content, err := json.Marshal(keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(location, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, keyID string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = keyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestAuthenticateJWTFromFile(t *testing.T) {
+	key := generateKey(t)
+	otherKey := generateKey(t)
+	authorizer, err := NewAuthorizer([]*Client{{ClientID: "static", Token: "static-token"}}, &JWTConfig{
+		JWKSLocation:      writeJWKS(t, key, testKeyID),
+		Issuer:            testIssuer,
+		Audience:          testAudience,
+		ClientIDClaim:     "sub",
+		RepositoriesClaim: "repositories",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":          testIssuer,
+			"aud":          testAudience,
+			"sub":          "client-1",
+			"iat":          now.Unix(),
+			"exp":          now.Add(time.Hour).Unix(),
+			"repositories": "owner/one 1234",
+		}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "valid", token: signToken(t, key, testKeyID, claims(nil)), valid: true},
+		{name: "expired", token: signToken(t, key, testKeyID, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()}))},
+		{name: "wrong audience", token: signToken(t, key, testKeyID, claims(jwt.MapClaims{"aud": "someone-else"}))},
+		{name: "wrong issuer", token: signToken(t, key, testKeyID, claims(jwt.MapClaims{"iss": "https://evil.example.com"}))},
+		{name: "unknown key id", token: signToken(t, key, "key-2", claims(nil))},
+		{name: "signed by another key", token: signToken(t, otherKey, testKeyID, claims(nil))},
+		{name: "without client id", token: signToken(t, key, testKeyID, claims(jwt.MapClaims{"sub": ""}))},
+		{name: "not a token", token: "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := authorizer.AuthenticateToken(tt.token)
+			if !tt.valid {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Fatalf("AuthenticateToken() error = %v, want %v", err, ErrUnauthenticated)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AuthenticateToken() error = %v", err)
+			}
+			if identity.ClientID != "client-1" || identity.Method != "jwt" {
+				t.Errorf("identity = %v, want client-1 (jwt)", identity)
+			}
+			if !slices.Equal(identity.Fetch, []string{"owner/one", "1234"}) {
+				t.Errorf("identity may fetch %v, want [owner/one 1234]", identity.Fetch)
+			}
+		})
+	}
+
+	t.Run("static token", func(t *testing.T) {
+		identity, err := authorizer.AuthenticateToken("static-token")
+		if err != nil {
+			t.Fatalf("AuthenticateToken() error = %v", err)
+		}
+		if identity.ClientID != "static" {
+			t.Errorf("identity = %v, want static (token)", identity)
+		}
+	})
+}
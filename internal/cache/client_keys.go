@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const clientKeysRedisKey = "gsf:client-keys"
+
+// ErrClientKeyHeld rejects a key for a repository another client registered a key for, which would leave that
+// client unable to read the events of the repository
+var ErrClientKeyHeld = errors.New("another client holds the key for the repository")
+
+// ClientKey is the public key a client registered to receive end-to-end encrypted events for a repository
+type ClientKey struct {
+	ClientID       string    `json:"clientId"`
+	RepositoryID   string    `json:"repositoryId"`
+	KeyID          string    `json:"keyId"`
+	PublicKey      []byte    `json:"publicKey"`
+	TimeRegistered time.Time `json:"registeredTime"`
+}
+
+// ClientKeyRegistry holds the latest registered client key per repository, only the client that registered it
+// may replace it
+type ClientKeyRegistry interface {
+	Register(key *ClientKey) error
+	Lookup(repositoryId string) (*ClientKey, bool)
+}
+
+var ClientKeys ClientKeyRegistry
+
+func initializeClientKeys(store EventStore) ClientKeyRegistry {
+	if redisStore, ok := store.(*redisStore); ok {
+		return &redisClientKeys{redisClient: redisStore.redisClient}
+	}
+	return &inMemoryClientKeys{keys: make(map[string]*ClientKey)}
+}
+
+type inMemoryClientKeys struct {
+	mu   sync.Mutex
+	keys map[string]*ClientKey
+}
+
+func (i *inMemoryClientKeys) Register(key *ClientKey) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if registered, ok := i.keys[key.RepositoryID]; ok && registered.ClientID != key.ClientID {
+		return fmt.Errorf("%w: client %v", ErrClientKeyHeld, registered.ClientID)
+	}
+	i.keys[key.RepositoryID] = key
+	return nil
+}
+
+func (i *inMemoryClientKeys) Lookup(repositoryId string) (*ClientKey, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key, ok := i.keys[repositoryId]
+	return key, ok
+}
+
+type redisClientKeys struct {
+	redisClient *redis.Client
+}
+
+func (r *redisClientKeys) Register(key *ClientKey) error {
+	jsonRepresentation, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("could not parse client key: %w", err)
+	}
+	// watched, so a client registering at the same time on another server cannot take the key in between
+	return r.redisClient.Watch(func(tx *redis.Tx) error {
+		jsonKey, err := tx.HGet(clientKeysRedisKey, key.RepositoryID).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("could not get client key from RedisStore: %w", err)
+		}
+		if err == nil {
+			var registered ClientKey
+			if err := json.Unmarshal([]byte(jsonKey), &registered); err == nil && registered.ClientID != key.ClientID {
+				return fmt.Errorf("%w: client %v", ErrClientKeyHeld, registered.ClientID)
+			}
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(clientKeysRedisKey, key.RepositoryID, string(jsonRepresentation))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not store client key in RedisStore: %w", err)
+		}
+		return nil
+	}, clientKeysRedisKey)
+}
+
+func (r *redisClientKeys) Lookup(repositoryId string) (*ClientKey, bool) {
+	jsonKey, err := r.redisClient.HGet(clientKeysRedisKey, repositoryId).Result()
+	if err == redis.Nil {
+		return nil, false
+	}
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not get client key from RedisStore")
+		return nil, false
+	}
+	var key ClientKey
+	if err := json.Unmarshal([]byte(jsonKey), &key); err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not parse client key from RedisStore")
+		return nil, false
+	}
+	return &key, true
+}
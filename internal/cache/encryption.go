@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const encryptionKeySize = 32
+
+// Keyring holds the key encryption keys for cached events, by key id.
+// New events are encrypted with the active key, older events can be decrypted with any key in the ring.
+type Keyring struct {
+	keys        map[string][]byte
+	activeKeyID string
+}
+
+// ParseKeyring reads keys in the form `keyId:base64Key`, separated by newlines or commas.
+// Empty lines and lines starting with `#` are ignored. The last key is the active key,
+// so a key is rotated by appending a new one and keeping the old ones for decryption.
+func ParseKeyring(keys string) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string][]byte)}
+	entries := strings.FieldsFunc(keys, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		keyID, encodedKey, found := strings.Cut(entry, ":")
+		keyID = strings.TrimSpace(keyID)
+		if !found || keyID == "" {
+			return nil, fmt.Errorf("invalid encryption key entry, expected keyId:base64Key")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %w", keyID, err)
+		}
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("invalid encryption key %q: expected %d bytes, got %d", keyID, encryptionKeySize, len(key))
+		}
+		if _, exists := keyring.keys[keyID]; exists {
+			return nil, fmt.Errorf("duplicate encryption key %q", keyID)
+		}
+		keyring.keys[keyID] = key
+		keyring.activeKeyID = keyID
+	}
+	if keyring.activeKeyID == "" {
+		return nil, fmt.Errorf("no encryption keys found")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads the keys from a file, see ParseKeyring for the format
+func LoadKeyring(keyFileLocation string) (*Keyring, error) {
+	keys, err := os.ReadFile(keyFileLocation)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(keys))
+}
+
+// EnableEncryption makes every EventStore encrypt event bodies and headers at rest
+func EnableEncryption(keyring *Keyring) {
+	codec.keyring = keyring
+	sublogger.Info().Msgf("Encrypting cached events with key %v (%d keys available for decryption)",
+		keyring.activeKeyID, len(keyring.keys))
+}
+
+// envelope is the data encryption key of a single event, wrapped with a key from the keyring
+type envelope struct {
+	keyID      string
+	wrappedKey []byte
+	dataKey    []byte
+}
+
+func (k *Keyring) newEnvelope() (*envelope, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := encrypt(k.keys[k.activeKeyID], dataKey, []byte(k.activeKeyID))
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{
+		keyID:      k.activeKeyID,
+		wrappedKey: wrappedKey,
+		dataKey:    dataKey,
+	}, nil
+}
+
+func (k *Keyring) openEnvelope(keyID string, wrappedKey []byte) (*envelope, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+	dataKey, err := decrypt(key, wrappedKey, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key with key %q: %w", keyID, err)
+	}
+	return &envelope{
+		keyID:      keyID,
+		wrappedKey: wrappedKey,
+		dataKey:    dataKey,
+	}, nil
+}
+
+// encrypt uses AES-GCM, the returned ciphertext is prefixed with its nonce
+func encrypt(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,7 +2,10 @@ package cache
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
 	api "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/e2e"
 	"net/http"
 	"strings"
 	"time"
@@ -27,28 +30,35 @@ var Repositories RepositoryWatcher
 type EventStore interface {
 	Store(repositoryId string, event *api.WebhookEventInternal) bool
 	Remove(repositoryId string, event *api.WebhookEventInternal) bool
+	MarkRelayed(repositoryId string, eventId string) bool
 	RetrieveEventsForRepository(repositoryId string) []*api.WebhookEventInternal
 	CountEventsForRepository(repositoryId string) int
 	IsConnected() bool
 }
 
 func InitCache(repositoryIDs string, redisConfig *RedisConfig) []string {
-	if repositoryIDs == "" || len(repositoryIDs) <= 1 {
-		sublogger.Fatal().Msg("Did not receive any RepositoryID to watch")
-	}
-
 	var repoIds []string
-	if strings.Contains(repositoryIDs, delimiter) {
+	if repositoryIDs == "" {
+		repoIds = []string{}
+	} else if strings.Contains(repositoryIDs, delimiter) {
 		repoIds = strings.Split(repositoryIDs, delimiter)
 	} else {
 		repoIds = []string{repositoryIDs}
 	}
 
-	Repositories = createRepositoryWatcher()
+	Store = initializeStore(redisConfig)
+	Names = initializeRepositoryNames(Store)
+	Repositories = initializeRepositoryWatcher(Store)
+	repositoryIds := make([]string, 0, len(repoIds))
 	for _, repoId := range repoIds {
-		Repositories.AddRepository(repoId)
+		repositoryIds = append(repositoryIds, ResolveRepositoryID(repoId))
 	}
-	Store = initializeStore(redisConfig)
+	if len(repositoryIds) > 0 && !Repositories.SeedRepositories(repositoryIds) {
+		sublogger.Info().Msg("Keeping the watch list from the store, the given repositories are only used when it is empty")
+	}
+	ClientKeys = initializeClientKeys(Store)
+	Registrations = initializeRegistrations(Store)
+	Notifier = initializeEventNotifier(Store)
 	return repoIds
 }
 
@@ -73,21 +83,23 @@ func PrepareForShutdown() {
 
 func Event(targetRepositoryID string, event *api.WebhookEvent) error {
 	webhookEvent := api.ExternalToInternalEvent(event)
-	Store.Store(targetRepositoryID, webhookEvent)
+	if err := encryptForClient(targetRepositoryID, webhookEvent); err != nil {
+		return err
+	}
+	stored, err := storeEvent(targetRepositoryID, webhookEvent)
+	if err != nil {
+		return err
+	}
+	if stored {
+		Notifier.Notify(targetRepositoryID)
+	}
 	return nil
 }
 
 func InternalEvent(targetRepositoryID string, eventBodyBytes []byte, headers http.Header) (bool, error) {
 	deliveryId := headers.Get(api.DeliveryIdHeader)
 
-	webhookEventHeaders := make([]api.WebhookEventHeader, len(headers))
-	for key, value := range headers {
-		webhookEventHeader := api.WebhookEventHeader{
-			Key:        key,
-			FirstValue: value[0],
-		}
-		webhookEventHeaders = append(webhookEventHeaders, webhookEventHeader)
-	}
+	webhookEventHeaders := api.HTTPHeadersToEventHeaders(headers)
 
 	eventBody := bytes.NewBuffer(eventBodyBytes).String()
 	webhookEvent := &api.WebhookEventInternal{
@@ -97,6 +109,92 @@ func InternalEvent(targetRepositoryID string, eventBodyBytes []byte, headers htt
 		Headers:      webhookEventHeaders,
 		EventBody:    eventBody,
 	}
+	if err := encryptForClient(targetRepositoryID, webhookEvent); err != nil {
+		return false, err
+	}
 
-	return Store.Store(targetRepositoryID, webhookEvent), nil
+	stored, err := storeEvent(targetRepositoryID, webhookEvent)
+	if !stored {
+		return false, err
+	}
+	Notifier.Notify(targetRepositoryID)
+	return true, nil
+}
+
+// storeEvent stores the event, with an error when the outbox could not keep it, unlike for an event already stored
+func storeEvent(targetRepositoryID string, event *api.WebhookEventInternal) (bool, error) {
+	if outbox, ok := Store.(*outboxStore); ok {
+		return outbox.storeDurably(targetRepositoryID, event)
+	}
+	return Store.Store(targetRepositoryID, event), nil
+}
+
+// encryptForClient encrypts the event body for the client that registered a key for the repository, if any
+func encryptForClient(targetRepositoryID string, event *api.WebhookEventInternal) error {
+	if event.EndToEnd != nil || ClientKeys == nil {
+		return nil
+	}
+	clientKey, ok := ClientKeys.Lookup(targetRepositoryID)
+	if !ok {
+		return nil
+	}
+
+	ephemeralPublicKey, ciphertext, err := e2e.Seal(clientKey.PublicKey, []byte(event.EventBody), []byte(event.ID))
+	if err != nil {
+		return fmt.Errorf("could not encrypt event %v for client %v: %w", event.ID, clientKey.ClientID, err)
+	}
+	event.EventBody = base64.StdEncoding.EncodeToString(ciphertext)
+	event.EndToEnd = &api.EndToEndEncryption{
+		Algorithm:          e2e.Algorithm,
+		KeyID:              clientKey.KeyID,
+		EphemeralPublicKey: ephemeralPublicKey,
+	}
+	return nil
+}
+
+// PurgeEvents removes every cached event of the repository, returning how many were removed
+func PurgeEvents(repositoryId string) int {
+	purged := 0
+	for _, event := range Store.RetrieveEventsForRepository(repositoryId) {
+		if Store.Remove(repositoryId, event) {
+			purged++
+		}
+	}
+	return purged
+}
+
+// PendingEvents returns the events a consumer at the cursor has yet to receive, with the cursor after them.
+// Without a cursor these are the events not yet relayed, when resuming after a cursor
+// the events after it are included even if they were relayed to the consumer before it lost them.
+func PendingEvents(repositoryId string, cursor uint64) ([]*api.WebhookEventInternal, uint64) {
+	pending := make([]*api.WebhookEventInternal, 0)
+	for _, event := range Store.RetrieveEventsForRepository(repositoryId) {
+		resumed := cursor > 0 && event.Sequence > cursor
+		if event.IsRelayed && !resumed {
+			continue
+		}
+		pending = append(pending, event)
+	}
+	for _, event := range pending {
+		if event.Sequence > cursor {
+			cursor = event.Sequence
+		}
+	}
+	return pending, cursor
+}
+
+// UnrelayedEvents returns per repository how many events are not relayed yet, where a pattern counts the events of
+// every repository it matches
+func UnrelayedEvents(repositoryIds []string) map[string]int {
+	unrelayed := make(map[string]int)
+	for _, repositoryId := range repositoryIds {
+		for _, matchingRepositoryId := range MatchingRepositories(repositoryId) {
+			for _, event := range Store.RetrieveEventsForRepository(matchingRepositoryId) {
+				if !event.IsRelayed {
+					unrelayed[matchingRepositoryId]++
+				}
+			}
+		}
+	}
+	return unrelayed
 }
@@ -6,17 +6,20 @@ import (
 	"github.com/joostvdg/gitstafette/internal/otel_util"
 	otelapi "go.opentelemetry.io/otel/metric"
 	"sync"
+	"time"
 )
 
 type inMemoryStore struct {
 	mu              sync.Mutex
 	events          map[string][]*api.WebhookEventInternal
+	sequences       map[string]uint64
 	eventsHistogram otelapi.Int64Histogram
 }
 
 func NewInMemoryStore() *inMemoryStore {
 	i := new(inMemoryStore)
 	i.events = make(map[string][]*api.WebhookEventInternal)
+	i.sequences = make(map[string]uint64)
 
 	if !otel_util.IsOTelEnabled() {
 		return i
@@ -67,28 +70,53 @@ func (i *inMemoryStore) Store(repositoryId string, event *api.WebhookEventIntern
 		}
 	}
 
-	event.IsRelayed = false
-	events = append(events, event)
+	event.Sequence = i.sequences[repositoryId] + 1
+	sealedEvent, err := codec.seal(event)
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not prepare event for storage")
+		return false
+	}
+	sealedEvent.IsRelayed = false
+	i.sequences[repositoryId] = event.Sequence
+	events = append(events, sealedEvent)
 	i.events[repositoryId] = events
 	sublogger.Info().Msgf("Cached event for repository %v, currently holding %d events for the repository",
-		repositoryId, len(events))
+		DescribeRepository(repositoryId), len(events))
 	return true
 }
 
 func (i *inMemoryStore) RetrieveEventsForRepository(repositoryId string) []*api.WebhookEventInternal {
-	events := make([]*api.WebhookEventInternal, 0)
-	if i.CountEventsForRepository(repositoryId) > 0 {
-		events = i.events[repositoryId]
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	events := make([]*api.WebhookEventInternal, 0, len(i.events[repositoryId]))
+	for _, storedEvent := range i.events[repositoryId] {
+		event, err := codec.open(storedEvent)
+		if err != nil {
+			sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not read cached event")
+			continue
+		}
+		events = append(events, event)
 	}
 	return events
 }
 
-func (i *inMemoryStore) CountEventsForRepository(repositoryId string) int {
-	events := i.events[repositoryId]
-	if events == nil {
-		return 0
+func (i *inMemoryStore) MarkRelayed(repositoryId string, eventId string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, storedEvent := range i.events[repositoryId] {
+		if storedEvent.ID == eventId {
+			storedEvent.IsRelayed = true
+			storedEvent.TimeRelayed = time.Now()
+			return true
+		}
 	}
-	return len(events)
+	return false
+}
+
+func (i *inMemoryStore) CountEventsForRepository(repositoryId string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.events[repositoryId])
 }
 
 func (i *inMemoryStore) IsConnected() bool {
@@ -108,6 +136,9 @@ func (i *inMemoryStore) Remove(repositoryId string, event *api.WebhookEventInter
 			updatedEvents = append(updatedEvents, storedEvent)
 		}
 	}
+	if len(updatedEvents) == len(events) {
+		return false // not stored
+	}
 	i.events[repositoryId] = updatedEvents
 
 	// TODO optimize this, as it is not very efficient
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+const eventsRedisChannel = "gsf:events"
+
+// EventNotifier tells the streams subscribed to a repository an event was stored for it, so they need not poll the
+// store. Kept in Redis, the events stored by any server reach the streams on all servers.
+type EventNotifier interface {
+	Notify(repositoryId string)
+	// Subscribe returns a subscription to the events of the repositories, which may include names and patterns
+	Subscribe(repositoryIds []string) *Subscription
+}
+
+var Notifier EventNotifier
+
+func initializeEventNotifier(store EventStore) EventNotifier {
+	if redisStore, ok := store.(*redisStore); ok {
+		notifier := &redisEventNotifier{redisClient: redisStore.redisClient}
+		go notifier.receive()
+		return notifier
+	}
+	return &inMemoryEventNotifier{}
+}
+
+// Subscription signals on C when an event was stored for one of its repositories. Signals do not queue up,
+// once signalled the subscriber should retrieve all events it has yet to receive.
+type Subscription struct {
+	C             <-chan struct{}
+	signal        chan struct{}
+	repositoryIds []string
+	subscribers   *subscribers
+}
+
+// Close stops the signals, a subscription should be closed once its stream ends
+func (s *Subscription) Close() {
+	s.subscribers.remove(s)
+}
+
+func (s *Subscription) isFor(repositoryId string) bool {
+	for _, subscribed := range s.repositoryIds {
+		if subscribed == repositoryId || ResolveRepositoryID(subscribed) == repositoryId {
+			return true
+		}
+		if IsRepositoryPattern(subscribed) && matchesPattern([]string{subscribed}, repositoryId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscription) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+		// already signalled, the subscriber retrieves this event with the one before it
+	}
+}
+
+// subscribers are the subscriptions of the streams connected to this server
+type subscribers struct {
+	mu            sync.Mutex
+	subscriptions []*Subscription
+}
+
+func (s *subscribers) add(repositoryIds []string) *Subscription {
+	signal := make(chan struct{}, 1)
+	subscription := &Subscription{C: signal, signal: signal, repositoryIds: repositoryIds, subscribers: s}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions = append(s.subscriptions, subscription)
+	return subscription
+}
+
+func (s *subscribers) remove(subscription *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index, subscribed := range s.subscriptions {
+		if subscribed == subscription {
+			s.subscriptions = append(s.subscriptions[:index], s.subscriptions[index+1:]...)
+			return
+		}
+	}
+}
+
+func (s *subscribers) notify(repositoryId string) {
+	s.mu.Lock()
+	subscriptions := append([]*Subscription(nil), s.subscriptions...)
+	s.mu.Unlock()
+	// matching patterns may look up names in Redis, which is not done while holding the lock
+	for _, subscription := range subscriptions {
+		if subscription.isFor(repositoryId) {
+			subscription.notify()
+		}
+	}
+}
+
+type inMemoryEventNotifier struct {
+	subscribers subscribers
+}
+
+func (i *inMemoryEventNotifier) Notify(repositoryId string) {
+	i.subscribers.notify(repositoryId)
+}
+
+func (i *inMemoryEventNotifier) Subscribe(repositoryIds []string) *Subscription {
+	return i.subscribers.add(repositoryIds)
+}
+
+type redisEventNotifier struct {
+	redisClient *redis.Client
+	subscribers subscribers
+}
+
+func (r *redisEventNotifier) Notify(repositoryId string) {
+	if err := r.redisClient.Publish(eventsRedisChannel, repositoryId).Err(); err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not publish event notification to RedisStore")
+		// the streams on this server need not miss it
+		r.subscribers.notify(repositoryId)
+	}
+}
+
+func (r *redisEventNotifier) Subscribe(repositoryIds []string) *Subscription {
+	return r.subscribers.add(repositoryIds)
+}
+
+// receive passes the notifications published by all servers on to the subscriptions on this one,
+// the Redis client resubscribes by itself when the connection drops
+func (r *redisEventNotifier) receive() {
+	pubsub := r.redisClient.Subscribe(eventsRedisChannel)
+	defer pubsub.Close()
+	for message := range pubsub.Channel() {
+		r.subscribers.notify(message.Payload)
+	}
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/joostvdg/gitstafette/api/v1"
+)
+
+const outboxFileExtension = ".json"
+
+// outboxStore keeps a file per event next to the store it wraps, until the event is relayed. Events received but not
+// yet relayed when the process stops are loaded again when it starts, so none are lost with it.
+type outboxStore struct {
+	EventStore
+	// mu keeps storing an event and writing its file apart from relaying it and removing its file
+	mu        sync.Mutex
+	directory string
+}
+
+// EnableOutbox keeps the events in the directory until they are relayed, loading the events it already holds,
+// and returns how many it loaded
+func EnableOutbox(directory string) (int, error) {
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return 0, fmt.Errorf("could not create outbox directory %v: %w", directory, err)
+	}
+	outbox := &outboxStore{EventStore: Store, directory: directory}
+	loaded, err := outbox.load()
+	if err != nil {
+		return loaded, err
+	}
+	Store = outbox
+	return loaded, nil
+}
+
+// storeDurably stores the event, and only returns once its file is written
+func (o *outboxStore) storeDurably(repositoryId string, event *api.WebhookEventInternal) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.EventStore.Store(repositoryId, event) {
+		return false, nil
+	}
+	if err := o.write(repositoryId, event); err != nil {
+		o.EventStore.Remove(repositoryId, event)
+		return false, err
+	}
+	return true, nil
+}
+
+func (o *outboxStore) Store(repositoryId string, event *api.WebhookEventInternal) bool {
+	stored, err := o.storeDurably(repositoryId, event)
+	if err != nil {
+		sublogger.Error().Err(err).Str("repo", repositoryId).Str("event", event.ID).Msg("Could not write event to the outbox")
+	}
+	return stored
+}
+
+func (o *outboxStore) MarkRelayed(repositoryId string, eventId string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.EventStore.MarkRelayed(repositoryId, eventId) {
+		return false
+	}
+	o.delete(repositoryId, eventId)
+	return true
+}
+
+func (o *outboxStore) Remove(repositoryId string, event *api.WebhookEventInternal) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.delete(repositoryId, event.ID)
+	return o.EventStore.Remove(repositoryId, event)
+}
+
+func (o *outboxStore) repositoryDirectory(repositoryId string) string {
+	return filepath.Join(o.directory, url.PathEscape(repositoryId))
+}
+
+func (o *outboxStore) eventFile(repositoryId string, eventId string) string {
+	return filepath.Join(o.repositoryDirectory(repositoryId), url.PathEscape(eventId)+outboxFileExtension)
+}
+
+// write syncs the event to a temporary file before renaming it, so a file is either complete or not there at all, and
+// syncs the directory after, so the renamed file survives a crash
+func (o *outboxStore) write(repositoryId string, event *api.WebhookEventInternal) error {
+	sealedEvent, err := codec.seal(event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(sealedEvent)
+	if err != nil {
+		return err
+	}
+	directory := o.repositoryDirectory(repositoryId)
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(directory, ".event-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), o.eventFile(repositoryId, event.ID)); err != nil {
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (o *outboxStore) delete(repositoryId string, eventId string) {
+	if err := os.Remove(o.eventFile(repositoryId, eventId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Str("event", eventId).Msg("Could not remove event from the outbox")
+	}
+}
+
+// load stores the events in the outbox in the order they were received, as they are not relayed yet
+func (o *outboxStore) load() (int, error) {
+	repositoryDirectories, err := os.ReadDir(o.directory)
+	if err != nil {
+		return 0, fmt.Errorf("could not read outbox directory %v: %w", o.directory, err)
+	}
+	loaded := 0
+	for _, repositoryDirectory := range repositoryDirectories {
+		if !repositoryDirectory.IsDir() {
+			continue
+		}
+		repositoryId, err := url.PathUnescape(repositoryDirectory.Name())
+		if err != nil {
+			sublogger.Warn().Err(err).Msgf("Skipping outbox directory %v", repositoryDirectory.Name())
+			continue
+		}
+		events := o.readEvents(repositoryId)
+		sort.Slice(events, func(i, j int) bool { return events[i].TimeReceived.Before(events[j].TimeReceived) })
+		for _, event := range events {
+			if event.RepositoryName != "" && !IsRepositoryName(repositoryId) {
+				// the relay may know the repository only by its name, which the server sent along when it was received
+				LearnRepositoryName(repositoryId, event.RepositoryName)
+			}
+			if o.EventStore.Store(repositoryId, event) {
+				loaded++
+			}
+		}
+		if len(events) > 0 {
+			sublogger.Info().Msgf("Loaded %d events for repository %v from the outbox", len(events), DescribeRepository(repositoryId))
+		}
+	}
+	return loaded, nil
+}
+
+func (o *outboxStore) readEvents(repositoryId string) []*api.WebhookEventInternal {
+	events := make([]*api.WebhookEventInternal, 0)
+	files, err := os.ReadDir(o.repositoryDirectory(repositoryId))
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not read the outbox")
+		return events
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), outboxFileExtension) {
+			continue
+		}
+		path := filepath.Join(o.repositoryDirectory(repositoryId), file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			sublogger.Warn().Err(err).Msgf("Could not read outbox file %v", path)
+			continue
+		}
+		sealedEvent := new(api.WebhookEventInternal)
+		if err := json.Unmarshal(data, sealedEvent); err != nil {
+			sublogger.Warn().Err(err).Msgf("Skipping malformed outbox file %v", path)
+			continue
+		}
+		event, err := codec.open(sealedEvent)
+		if err != nil {
+			sublogger.Warn().Err(err).Msgf("Could not open outbox file %v", path)
+			continue
+		}
+		event.IsRelayed = false
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	api "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/otel_util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelapi "go.opentelemetry.io/otel/metric"
+)
+
+const (
+	compressionGzip = "gzip"
+
+	// bodies smaller than this are not worth compressing
+	compressionThreshold = 1024
+)
+
+// payloadCodec converts events between their in-flight and at-rest representation
+type payloadCodec struct {
+	compress         bool
+	keyring          *Keyring
+	rawBytes         otelapi.Int64Counter
+	storedBytes      otelapi.Int64Counter
+	metricsAvailable bool
+}
+
+var codec = &payloadCodec{}
+
+// EnableCompression makes every EventStore gzip event bodies at rest
+func EnableCompression() {
+	codec.compress = true
+	sublogger.Info().Msgf("Compressing cached event bodies of %d bytes or more", compressionThreshold)
+	if !otel_util.IsOTelEnabled() {
+		return
+	}
+
+	meter := otel.GetMeterProvider().Meter("gsf-cache")
+	rawBytes, err := meter.Int64Counter("cached_payload_raw_bytes",
+		otelapi.WithDescription("Size of the cached event bodies before compression"),
+		otelapi.WithUnit("By"))
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Encountered an error when creating counter")
+		return
+	}
+	storedBytes, err := meter.Int64Counter("cached_payload_stored_bytes",
+		otelapi.WithDescription("Size of the cached event bodies as stored"),
+		otelapi.WithUnit("By"))
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Encountered an error when creating counter")
+		return
+	}
+	codec.rawBytes = rawBytes
+	codec.storedBytes = storedBytes
+	codec.metricsAvailable = true
+}
+
+// seal returns a copy of the event in the form it should be stored in
+func (c *payloadCodec) seal(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	sealed, err := c.compressBody(event)
+	if err != nil {
+		return nil, err
+	}
+	if c.keyring == nil || sealed.KeyID != "" {
+		return sealed, nil
+	}
+	return c.encryptEvent(sealed)
+}
+
+// open returns a copy of a stored event with its headers and body restored
+func (c *payloadCodec) open(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	opened := event
+	if event.KeyID != "" {
+		decrypted, err := c.decryptEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		opened = decrypted
+	}
+	return c.decompressBody(opened)
+}
+
+func (c *payloadCodec) compressBody(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	compressed := *event
+	if !c.compress || event.Compression != "" || event.KeyID != "" || len(event.EventBody) < compressionThreshold {
+		return &compressed, nil
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(event.EventBody)); err != nil {
+		return nil, fmt.Errorf("could not compress event %v: %w", event.ID, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("could not compress event %v: %w", event.ID, err)
+	}
+
+	compressed.Payload = buffer.Bytes()
+	compressed.Compression = compressionGzip
+	compressed.EventBody = ""
+	if c.metricsAvailable {
+		attributes := otelapi.WithAttributes(attribute.String("compression", compressionGzip))
+		c.rawBytes.Add(context.Background(), int64(len(event.EventBody)), attributes)
+		c.storedBytes.Add(context.Background(), int64(len(compressed.Payload)), attributes)
+	}
+	return &compressed, nil
+}
+
+func (c *payloadCodec) decompressBody(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	decompressed := *event
+	switch event.Compression {
+	case "":
+		return &decompressed, nil
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(event.Payload))
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress event %v: %w", event.ID, err)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress event %v: %w", event.ID, err)
+		}
+		decompressed.EventBody = string(body)
+		decompressed.Payload = nil
+		decompressed.Compression = ""
+		return &decompressed, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q for event %v", event.Compression, event.ID)
+	}
+}
+
+// encryptEvent replaces the body and headers by their ciphertext, bound to the event id and to which of the two they are,
+// so neither can be moved to another event nor swapped with the other
+func (c *payloadCodec) encryptEvent(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	envelope, err := c.keyring.newEnvelope()
+	if err != nil {
+		return nil, fmt.Errorf("could not create data key for event %v: %w", event.ID, err)
+	}
+
+	headers, err := json.Marshal(event.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt headers of event %v: %w", event.ID, err)
+	}
+	sealedHeaders, err := encrypt(envelope.dataKey, headers, headersAdditionalData(event))
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt headers of event %v: %w", event.ID, err)
+	}
+
+	body := event.Payload
+	if event.Compression == "" {
+		body = []byte(event.EventBody)
+	}
+	sealedBody, err := encrypt(envelope.dataKey, body, bodyAdditionalData(event))
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt body of event %v: %w", event.ID, err)
+	}
+
+	encrypted := *event
+	encrypted.Headers = nil
+	encrypted.EventBody = ""
+	encrypted.SealedHeaders = sealedHeaders
+	encrypted.Payload = sealedBody
+	encrypted.KeyID = envelope.keyID
+	encrypted.WrappedKey = envelope.wrappedKey
+	return &encrypted, nil
+}
+
+func (c *payloadCodec) decryptEvent(event *api.WebhookEventInternal) (*api.WebhookEventInternal, error) {
+	if c.keyring == nil {
+		return nil, fmt.Errorf("event %v is encrypted with key %q, but encryption is not enabled", event.ID, event.KeyID)
+	}
+	envelope, err := c.keyring.openEnvelope(event.KeyID, event.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt event %v: %w", event.ID, err)
+	}
+
+	headers, err := decrypt(envelope.dataKey, event.SealedHeaders, headersAdditionalData(event))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt headers of event %v: %w", event.ID, err)
+	}
+	body, err := decrypt(envelope.dataKey, event.Payload, bodyAdditionalData(event))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt body of event %v: %w", event.ID, err)
+	}
+
+	decrypted := *event
+	if err := json.Unmarshal(headers, &decrypted.Headers); err != nil {
+		return nil, fmt.Errorf("could not decrypt headers of event %v: %w", event.ID, err)
+	}
+	if event.Compression == "" {
+		decrypted.EventBody = string(body)
+		decrypted.Payload = nil
+	} else {
+		decrypted.Payload = body
+	}
+	decrypted.SealedHeaders = nil
+	decrypted.KeyID = ""
+	decrypted.WrappedKey = nil
+	return &decrypted, nil
+}
+
+func headersAdditionalData(event *api.WebhookEventInternal) []byte {
+	return []byte(event.ID + ":headers")
+}
+
+func bodyAdditionalData(event *api.WebhookEventInternal) []byte {
+	return []byte(event.ID + ":body")
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	api "github.com/joostvdg/gitstafette/api/v1"
+)
+
+func testKeyring(t *testing.T, keyIDs ...string) *Keyring {
+	t.Helper()
+	entries := make([]string, 0, len(keyIDs))
+	for i, keyID := range keyIDs {
+		key := strings.Repeat(string(rune('a'+i)), encryptionKeySize)
+		entries = append(entries, keyID+":"+base64.StdEncoding.EncodeToString([]byte(key)))
+	}
+	keyring, err := ParseKeyring(strings.Join(entries, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func testEvent(bodySize int) *api.WebhookEventInternal {
+	return &api.WebhookEventInternal{
+		ID:        "delivery-1",
+		Headers:   []api.WebhookEventHeader{{Key: "X-Github-Event", Values: []string{"push"}}},
+		EventBody: strings.Repeat("x", bodySize),
+	}
+}
+
+func TestPayloadCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		compress    bool
+		encrypt     bool
+		bodySize    int
+		compression string
+	}{
+		{name: "plain", bodySize: 2 * compressionThreshold},
+		{name: "compressed", compress: true, bodySize: 2 * compressionThreshold, compression: compressionGzip},
+		{name: "small body is not compressed", compress: true, bodySize: 10},
+		{name: "encrypted", encrypt: true, bodySize: 2 * compressionThreshold},
+		{name: "compressed and encrypted", compress: true, encrypt: true, bodySize: 2 * compressionThreshold, compression: compressionGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &payloadCodec{compress: tt.compress}
+			if tt.encrypt {
+				c.keyring = testKeyring(t, "key-1")
+			}
+			event := testEvent(tt.bodySize)
+
+			sealed, err := c.seal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sealed.Compression != tt.compression {
+				t.Errorf("compression = %q, want %q", sealed.Compression, tt.compression)
+			}
+			if tt.encrypt {
+				if sealed.KeyID != "key-1" || sealed.EventBody != "" || sealed.Headers != nil {
+					t.Errorf("sealed event keeps plain text or lacks its key: %+v", sealed)
+				}
+			} else if sealed.KeyID != "" {
+				t.Errorf("sealed event is encrypted with key %q, want none", sealed.KeyID)
+			}
+
+			opened, err := c.open(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(opened, event) {
+				t.Errorf("opened event = %+v, want %+v", opened, event)
+			}
+		})
+	}
+}
+
+func TestPayloadCodecRotation(t *testing.T) {
+	event := testEvent(10)
+	sealed, err := (&payloadCodec{keyring: testKeyring(t, "key-1")}).seal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := &payloadCodec{keyring: testKeyring(t, "key-1", "key-2")}
+	opened, err := rotated.open(sealed)
+	if err != nil {
+		t.Fatalf("event sealed with the previous key could not be opened: %v", err)
+	}
+	if !reflect.DeepEqual(opened, event) {
+		t.Errorf("opened event = %+v, want %+v", opened, event)
+	}
+	resealed, err := rotated.seal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed.KeyID != "key-2" {
+		t.Errorf("new event sealed with key %q, want key-2", resealed.KeyID)
+	}
+
+	if _, err := (&payloadCodec{keyring: testKeyring(t, "key-2")}).open(sealed); err == nil {
+		t.Error("event sealed with a removed key could be opened")
+	}
+}
+
+func TestPayloadCodecRejectsTampering(t *testing.T) {
+	c := &payloadCodec{keyring: testKeyring(t, "key-1")}
+	event := testEvent(0)
+	// a body that also reads as headers, so only the additional data tells them apart
+	event.EventBody = `[{"key":"X-Github-Event","values":["ping"]}]`
+	sealed, err := c.seal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := c.seal(&api.WebhookEventInternal{ID: "delivery-2", EventBody: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(content []byte) []byte {
+		tampered := append([]byte{}, content...)
+		tampered[len(tampered)-1] ^= 0x01
+		return tampered
+	}
+	tests := []struct {
+		name   string
+		tamper func(event *api.WebhookEventInternal)
+	}{
+		{name: "body", tamper: func(event *api.WebhookEventInternal) { event.Payload = flip(event.Payload) }},
+		{name: "headers", tamper: func(event *api.WebhookEventInternal) { event.SealedHeaders = flip(event.SealedHeaders) }},
+		{name: "wrapped key", tamper: func(event *api.WebhookEventInternal) { event.WrappedKey = flip(event.WrappedKey) }},
+		{name: "event id", tamper: func(event *api.WebhookEventInternal) { event.ID = "delivery-2" }},
+		{name: "swapped body and headers", tamper: func(event *api.WebhookEventInternal) {
+			event.Payload, event.SealedHeaders = event.SealedHeaders, event.Payload
+		}},
+		{name: "body of another event", tamper: func(event *api.WebhookEventInternal) {
+			event.Payload, event.WrappedKey = other.Payload, other.WrappedKey
+		}},
+		{name: "unknown key", tamper: func(event *api.WebhookEventInternal) { event.KeyID = "key-2" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := *sealed
+			tt.tamper(&tampered)
+			if _, err := c.open(&tampered); err == nil {
+				t.Error("tampered event could be opened")
+			}
+		})
+	}
+}
+
+func TestPayloadCodecLegacyEvents(t *testing.T) {
+	event := testEvent(2 * compressionThreshold)
+	c := &payloadCodec{compress: true, keyring: testKeyring(t, "key-1")}
+	opened, err := c.open(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened, event) {
+		t.Errorf("opened plain text event = %+v, want %+v", opened, event)
+	}
+
+	sealed, err := c.seal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&payloadCodec{}).open(sealed); err == nil {
+		t.Error("encrypted event could be opened without encryption enabled")
+	}
+}
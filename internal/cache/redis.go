@@ -7,9 +7,29 @@ import (
 	"github.com/go-redis/redis"
 	api "github.com/joostvdg/gitstafette/api/v1"
 	"log"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// the sequences live apart from the events, so they keep increasing when all events are removed
+const sequenceRedisKeyPrefix = "gsf:sequence:"
+
+func sequenceRedisKey(repositoryId string) string {
+	return sequenceRedisKeyPrefix + repositoryId
+}
+
+// the IDs of the events stored per repository, so storing an event need not read every event to skip duplicates
+const eventIdsRedisKeyPrefix = "gsf:event-ids:"
+
+func eventIdsRedisKey(repositoryId string) string {
+	return eventIdsRedisKeyPrefix + repositoryId
+}
+
+// the repositories whose event list is ordered from oldest to newest and has its IDs in the set, see migrate
+const migratedRepositoriesRedisKey = "gsf:migrated-repositories"
+
 type RedisConfig struct {
 	Host     string
 	Port     string
@@ -20,6 +40,8 @@ type RedisConfig struct {
 type redisStore struct {
 	redisClient *redis.Client
 	isConnected bool
+	// the repositories known to be migrated, so we ask Redis only once per repository
+	migrated sync.Map
 }
 
 func NewRedisStore(config *RedisConfig) *redisStore {
@@ -53,7 +75,48 @@ func (r *redisStore) IsConnected() bool {
 }
 
 func (r *redisStore) Store(repositoryId string, event *api.WebhookEventInternal) bool {
-	jsonRepresentation, err := json.Marshal(event)
+	r.migrate(repositoryId)
+	// adding the ID claims the event, so of the servers storing the same delivery only one stores it
+	added, err := r.redisClient.SAdd(eventIdsRedisKey(repositoryId), event.ID).Result()
+	if err != nil {
+		errorMessage := fmt.Sprintf("Could not claim event %v in RedisStore for Repo %v: %v", event.ID, repositoryId, err)
+		log.Print(errorMessage)
+		sentry.CaptureMessage(errorMessage)
+		return false
+	}
+	if added == 0 {
+		log.Printf("Already stored event %v for Repo %v, skipping", event.ID, repositoryId)
+		return false
+	}
+	if !r.push(repositoryId, event) {
+		// released, so a redelivery of the event is stored
+		r.redisClient.SRem(eventIdsRedisKey(repositoryId), event.ID)
+		return false
+	}
+	return true
+}
+
+// push appends the event to the list of the repository, so the list is ordered from oldest to newest
+func (r *redisStore) push(repositoryId string, event *api.WebhookEventInternal) bool {
+	sequence, err := r.redisClient.Incr(sequenceRedisKey(repositoryId)).Result()
+	if err != nil {
+		errorMessage := fmt.Sprintf("Could not assign a sequence to the event in RedisStore for Repo %v: %v", repositoryId, err)
+		log.Print(errorMessage)
+		sentry.CaptureMessage(errorMessage)
+		return false
+	}
+	event.Sequence = uint64(sequence)
+
+	sealedEvent, err := codec.seal(event)
+	if err != nil {
+		errorMessage := fmt.Sprintf("Could not prepare event for RedisStore: %v", err)
+		log.Print(errorMessage)
+		sentry.CaptureMessage(errorMessage)
+		return false
+	}
+	sealedEvent.IsRelayed = false
+
+	jsonRepresentation, err := json.Marshal(sealedEvent)
 	if err != nil {
 		errorMessage := fmt.Sprintf("Could not parse event: %v", err)
 		log.Print(errorMessage)
@@ -61,7 +124,7 @@ func (r *redisStore) Store(repositoryId string, event *api.WebhookEventInternal)
 		return false
 	}
 
-	response := r.redisClient.LPush(repositoryId, string(jsonRepresentation))
+	response := r.redisClient.RPush(repositoryId, string(jsonRepresentation))
 	numAffected, err := response.Result()
 	if err != nil || numAffected <= 0 {
 		errorMessage := fmt.Sprintf("Could not store event in RedisStore for Repo %v: %v", repositoryId, err)
@@ -73,20 +136,26 @@ func (r *redisStore) Store(repositoryId string, event *api.WebhookEventInternal)
 }
 
 func (r *redisStore) RetrieveEventsForRepository(repositoryId string) []*api.WebhookEventInternal {
+	r.migrate(repositoryId)
 	events := make([]*api.WebhookEventInternal, 0)
-	numberOfRecords := r.CountEventsForRepository(repositoryId)
-	for i := 0; i < numberOfRecords; i++ {
-		result := r.redisClient.RPop(repositoryId)
-		jsonEvent, err := result.Result()
+	jsonEvents, err := r.redisClient.LRange(repositoryId, 0, -1).Result()
+	if err != nil {
+		log.Printf("Could not get events in RedisStore for Repo %v: %v", repositoryId, err)
+		return events
+	}
+	for _, jsonEvent := range jsonEvents {
+		var storedEvent api.WebhookEventInternal
+		err = json.Unmarshal([]byte(jsonEvent), &storedEvent)
 		if err != nil {
-			log.Printf("Could get events in RedisStore for Repo %v", repositoryId)
-			break
+			log.Printf("Could not parse event from RedisStore for %v: %v", repositoryId, err)
+			continue
 		}
-		var event api.WebhookEventInternal
-		err = json.Unmarshal([]byte(jsonEvent), &event)
+		event, err := codec.open(&storedEvent)
 		if err != nil {
-			log.Printf("Could not parse event from RedisStore for %v: %v", repositoryId, err)
+			log.Printf("Could not read event from RedisStore for %v: %v", repositoryId, err)
+			continue
 		}
+		events = append(events, event)
 	}
 
 	return events
@@ -102,6 +171,116 @@ func (r *redisStore) CountEventsForRepository(repositoryId string) int {
 	return int(numberOfItems)
 }
 
+// updateEvent applies update to the stored representation of an event, without other writers interfering
+func (r *redisStore) updateEvent(repositoryId string, eventId string, update func(tx *redis.Tx, index int64, jsonEvent string, event *api.WebhookEventInternal) error) bool {
+	found := false
+	err := r.redisClient.Watch(func(tx *redis.Tx) error {
+		jsonEvents, err := tx.LRange(repositoryId, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for index, jsonEvent := range jsonEvents {
+			var storedEvent api.WebhookEventInternal
+			if err := json.Unmarshal([]byte(jsonEvent), &storedEvent); err != nil || storedEvent.ID != eventId {
+				continue
+			}
+			found = true
+			return update(tx, int64(index), jsonEvent, &storedEvent)
+		}
+		return nil
+	}, repositoryId)
+	if err != nil {
+		log.Printf("Could not update event %v in RedisStore for Repo %v: %v", eventId, repositoryId, err)
+		return false
+	}
+	return found
+}
+
+func (r *redisStore) MarkRelayed(repositoryId string, eventId string) bool {
+	return r.updateEvent(repositoryId, eventId, func(tx *redis.Tx, index int64, _ string, event *api.WebhookEventInternal) error {
+		event.IsRelayed = true
+		event.TimeRelayed = time.Now()
+		jsonRepresentation, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.LSet(repositoryId, index, string(jsonRepresentation))
+			return nil
+		})
+		return err
+	})
+}
+
 func (r *redisStore) Remove(repositoryId string, event *api.WebhookEventInternal) bool {
-	return false
+	return r.updateEvent(repositoryId, event.ID, func(tx *redis.Tx, _ int64, jsonEvent string, _ *api.WebhookEventInternal) error {
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.LRem(repositoryId, 1, jsonEvent)
+			pipe.SRem(eventIdsRedisKey(repositoryId), event.ID)
+			return nil
+		})
+		return err
+	})
+}
+
+// migrate brings the event list of the repository in the form this version keeps it in. Versions before pushed
+// events to the head of the list and had no set of event IDs, so the list is ordered by the time the events were
+// received and their IDs are added to the set, once for every repository.
+func (r *redisStore) migrate(repositoryId string) {
+	if _, ok := r.migrated.Load(repositoryId); ok {
+		return
+	}
+	migrated, err := r.redisClient.SIsMember(migratedRepositoriesRedisKey, repositoryId).Result()
+	if err != nil {
+		log.Printf("Could not check if the events of Repo %v in RedisStore are migrated: %v", repositoryId, err)
+		return
+	}
+	if !migrated {
+		err = r.redisClient.Watch(func(tx *redis.Tx) error {
+			jsonEvents, err := tx.LRange(repositoryId, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			type storedEvent struct {
+				json  string
+				event api.WebhookEventInternal
+			}
+			storedEvents := make([]storedEvent, 0, len(jsonEvents))
+			for _, jsonEvent := range jsonEvents {
+				stored := storedEvent{json: jsonEvent}
+				if err := json.Unmarshal([]byte(jsonEvent), &stored.event); err != nil {
+					log.Printf("Could not parse event from RedisStore for %v, keeping it last: %v", repositoryId, err)
+				}
+				storedEvents = append(storedEvents, stored)
+			}
+			sort.SliceStable(storedEvents, func(i, j int) bool {
+				return storedEvents[i].event.TimeReceived.Before(storedEvents[j].event.TimeReceived)
+			})
+			ordered := make([]interface{}, 0, len(storedEvents))
+			eventIds := make([]interface{}, 0, len(storedEvents))
+			for _, stored := range storedEvents {
+				ordered = append(ordered, stored.json)
+				if stored.event.ID != "" {
+					eventIds = append(eventIds, stored.event.ID)
+				}
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if len(ordered) > 0 {
+					pipe.Del(repositoryId)
+					pipe.RPush(repositoryId, ordered...)
+				}
+				if len(eventIds) > 0 {
+					pipe.SAdd(eventIdsRedisKey(repositoryId), eventIds...)
+				}
+				pipe.SAdd(migratedRepositoriesRedisKey, repositoryId)
+				return nil
+			})
+			return err
+		}, repositoryId)
+		if err != nil {
+			log.Printf("Could not migrate the events of Repo %v in RedisStore: %v", repositoryId, err)
+			return
+		}
+	}
+	r.migrated.Store(repositoryId, true)
 }
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	registrationsRedisKey = "gsf:registrations"
+	// registrationCheckInterval is how often registered repositories are checked for expiry
+	registrationCheckInterval = time.Minute
+)
+
+// RepositoryRegistrations tracks the repositories clients registered, with the last time a client connected for them.
+// Repositories watched through configuration are not registrations, and never expire.
+type RepositoryRegistrations interface {
+	Register(repositoryId string) bool
+	// Touch records a client connected for the repository, if it is registered
+	Touch(repositoryId string)
+	IsRegistered(repositoryId string) bool
+	// Expired returns the registered repositories no client connected for since the time
+	Expired(since time.Time) []string
+	Forget(repositoryId string)
+}
+
+var Registrations RepositoryRegistrations
+
+func initializeRegistrations(store EventStore) RepositoryRegistrations {
+	if redisStore, ok := store.(*redisStore); ok {
+		return &redisRegistrations{redisClient: redisStore.redisClient}
+	}
+	return &inMemoryRegistrations{lastSeen: make(map[string]time.Time)}
+}
+
+// RegisterRepository watches the repository for a client, returning false if it could not be watched
+func RegisterRepository(repositoryId string) bool {
+	if Repositories.AddRepository(repositoryId) {
+		return Registrations.Register(repositoryId)
+	}
+	if Registrations.IsRegistered(repositoryId) {
+		Registrations.Touch(repositoryId)
+	}
+	return Repositories.RepositoryIsWatched(repositoryId)
+}
+
+// ExpireRegistrations stops watching registered repositories no client connected for within the grace period,
+// purging their cached events, until the context is done
+func ExpireRegistrations(ctx context.Context, gracePeriod time.Duration) {
+	clock := time.NewTicker(registrationCheckInterval)
+	defer clock.Stop()
+	for {
+		select {
+		case <-clock.C:
+			for _, repositoryId := range Registrations.Expired(time.Now().Add(-gracePeriod)) {
+				Repositories.RemoveRepository(repositoryId)
+				Registrations.Forget(repositoryId)
+				purged := PurgeEvents(repositoryId)
+				sublogger.Info().Msgf("No client connected for repository %v within %v, no longer watching it (purged %d cached events)",
+					repositoryId, gracePeriod, purged)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type inMemoryRegistrations struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func (i *inMemoryRegistrations) Register(repositoryId string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.lastSeen[repositoryId] = time.Now()
+	return true
+}
+
+func (i *inMemoryRegistrations) Touch(repositoryId string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.lastSeen[repositoryId]; ok {
+		i.lastSeen[repositoryId] = time.Now()
+	}
+}
+
+func (i *inMemoryRegistrations) IsRegistered(repositoryId string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, ok := i.lastSeen[repositoryId]
+	return ok
+}
+
+func (i *inMemoryRegistrations) Expired(since time.Time) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	expired := make([]string, 0)
+	for repositoryId, lastSeen := range i.lastSeen {
+		if lastSeen.Before(since) {
+			expired = append(expired, repositoryId)
+		}
+	}
+	return expired
+}
+
+func (i *inMemoryRegistrations) Forget(repositoryId string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.lastSeen, repositoryId)
+}
+
+// redisRegistrations keeps the last time seen as unix seconds, so every server sees the connections of the others
+type redisRegistrations struct {
+	redisClient *redis.Client
+}
+
+func (r *redisRegistrations) Register(repositoryId string) bool {
+	if err := r.redisClient.HSet(registrationsRedisKey, repositoryId, time.Now().Unix()).Err(); err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not store repository registration in RedisStore")
+		return false
+	}
+	return true
+}
+
+func (r *redisRegistrations) Touch(repositoryId string) {
+	if r.IsRegistered(repositoryId) {
+		r.Register(repositoryId)
+	}
+}
+
+func (r *redisRegistrations) IsRegistered(repositoryId string) bool {
+	registered, err := r.redisClient.HExists(registrationsRedisKey, repositoryId).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not get repository registration from RedisStore")
+		return false
+	}
+	return registered
+}
+
+func (r *redisRegistrations) Expired(since time.Time) []string {
+	expired := make([]string, 0)
+	registrations, err := r.redisClient.HGetAll(registrationsRedisKey).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Could not get repository registrations from RedisStore")
+		return expired
+	}
+	for repositoryId, value := range registrations {
+		lastSeen, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || time.Unix(lastSeen, 0).Before(since) {
+			expired = append(expired, repositoryId)
+		}
+	}
+	return expired
+}
+
+func (r *redisRegistrations) Forget(repositoryId string) {
+	if err := r.redisClient.HDel(registrationsRedisKey, repositoryId).Err(); err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not remove repository registration from RedisStore")
+	}
+}
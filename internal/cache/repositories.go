@@ -2,34 +2,187 @@ package cache
 
 import (
 	"log"
+	"slices"
+	"sync"
+
+	"github.com/go-redis/redis"
 )
 
-type RepositoryWatcher struct {
-	Repositories []string
+const watchlistRedisKey = "gsf:watchlist"
+
+// RepositoryWatcher holds the repositories whose events are accepted, shared by all servers when kept in Redis.
+// Besides IDs and full names it may hold patterns, which watch every repository whose full name matches.
+type RepositoryWatcher interface {
+	AddRepository(repositoryId string) bool
+	RemoveRepository(repositoryId string) bool
+	// RepositoryIsWatched tells if the repository is in the list, or matched by a pattern in the list
+	RepositoryIsWatched(repositoryID string) bool
+	WatchedRepositories() []string
+	// SeedRepositories adds the repositories only if none are watched yet, so a restart with the same flags does not
+	// bring back repositories removed at runtime. It tells if the repositories were added.
+	SeedRepositories(repositoryIds []string) bool
 }
 
-func createRepositoryWatcher() RepositoryWatcher {
-	return RepositoryWatcher{
-		Repositories: make([]string, 0),
+func initializeRepositoryWatcher(store EventStore) RepositoryWatcher {
+	if redisStore, ok := store.(*redisStore); ok {
+		return &redisRepositoryWatcher{redisClient: redisStore.redisClient}
 	}
+	return &inMemoryRepositoryWatcher{repositories: make([]string, 0)}
 }
 
-func (r *RepositoryWatcher) AddRepository(repositoryId string) {
-	r.Repositories = append(r.Repositories, repositoryId)
+// matchesPattern tells if one of the watched patterns matches the full name of the repository, once known. Names are
+// only learned from verified webhooks, so whoever sends an unverified one cannot get a repository matched.
+func matchesPattern(watched []string, repositoryID string) bool {
+	if Names == nil {
+		return false
+	}
+	name, ok := Names.Name(repositoryID)
+	if !ok {
+		return false
+	}
+	return slices.ContainsFunc(watched, func(pattern string) bool {
+		return IsRepositoryPattern(pattern) && RepositoryMatches(pattern, name)
+	})
 }
 
-func (r *RepositoryWatcher) RepositoryIsWatched(repositoryID string) bool {
-	for _, value := range r.Repositories {
-		if value == repositoryID {
-			return true
+// WatchedRepositoryIDs returns the watched repositories, with patterns replaced by the repositories they match
+func WatchedRepositoryIDs() []string {
+	repositoryIds := make([]string, 0)
+	for _, watched := range Repositories.WatchedRepositories() {
+		for _, repositoryId := range MatchingRepositories(watched) {
+			if !slices.Contains(repositoryIds, repositoryId) {
+				repositoryIds = append(repositoryIds, repositoryId)
+			}
 		}
 	}
-	return false
+	return repositoryIds
 }
 
-func (r *RepositoryWatcher) ReportWatchedRepositories() {
+func ReportWatchedRepositories() {
 	log.Println("Watching repos:")
-	for _, repoId := range r.Repositories {
+	for _, repoId := range Repositories.WatchedRepositories() {
 		log.Printf(" - %v\n", repoId)
 	}
 }
+
+type inMemoryRepositoryWatcher struct {
+	mu           sync.Mutex
+	repositories []string
+}
+
+func (i *inMemoryRepositoryWatcher) AddRepository(repositoryId string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if slices.Contains(i.repositories, repositoryId) {
+		return false
+	}
+	i.repositories = append(i.repositories, repositoryId)
+	return true
+}
+
+func (i *inMemoryRepositoryWatcher) RemoveRepository(repositoryId string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	index := slices.Index(i.repositories, repositoryId)
+	if index < 0 {
+		return false
+	}
+	i.repositories = slices.Delete(i.repositories, index, index+1)
+	return true
+}
+
+func (i *inMemoryRepositoryWatcher) RepositoryIsWatched(repositoryID string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return slices.Contains(i.repositories, repositoryID) || matchesPattern(i.repositories, repositoryID)
+}
+
+func (i *inMemoryRepositoryWatcher) WatchedRepositories() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return slices.Clone(i.repositories)
+}
+
+func (i *inMemoryRepositoryWatcher) SeedRepositories(repositoryIds []string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.repositories) > 0 {
+		return false
+	}
+	for _, repositoryId := range repositoryIds {
+		if !slices.Contains(i.repositories, repositoryId) {
+			i.repositories = append(i.repositories, repositoryId)
+		}
+	}
+	return true
+}
+
+type redisRepositoryWatcher struct {
+	redisClient *redis.Client
+}
+
+func (r *redisRepositoryWatcher) AddRepository(repositoryId string) bool {
+	added, err := r.redisClient.SAdd(watchlistRedisKey, repositoryId).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not add repository to the watch list in RedisStore")
+		return false
+	}
+	return added > 0
+}
+
+func (r *redisRepositoryWatcher) RemoveRepository(repositoryId string) bool {
+	removed, err := r.redisClient.SRem(watchlistRedisKey, repositoryId).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not remove repository from the watch list in RedisStore")
+		return false
+	}
+	return removed > 0
+}
+
+func (r *redisRepositoryWatcher) RepositoryIsWatched(repositoryID string) bool {
+	watched, err := r.redisClient.SIsMember(watchlistRedisKey, repositoryID).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryID).Msg("Could not check the watch list in RedisStore")
+		return false
+	}
+	return watched || matchesPattern(r.WatchedRepositories(), repositoryID)
+}
+
+func (r *redisRepositoryWatcher) WatchedRepositories() []string {
+	repositories, err := r.redisClient.SMembers(watchlistRedisKey).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Could not get the watch list from RedisStore")
+		return make([]string, 0)
+	}
+	slices.Sort(repositories)
+	return repositories
+}
+
+func (r *redisRepositoryWatcher) SeedRepositories(repositoryIds []string) bool {
+	if len(repositoryIds) == 0 {
+		return false
+	}
+	members := make([]interface{}, 0, len(repositoryIds))
+	for _, repositoryId := range repositoryIds {
+		members = append(members, repositoryId)
+	}
+	seeded := false
+	// watched, so of several servers starting at once only one seeds the list
+	err := r.redisClient.Watch(func(tx *redis.Tx) error {
+		count, err := tx.SCard(watchlistRedisKey).Result()
+		if err != nil || count > 0 {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.SAdd(watchlistRedisKey, members...)
+			return nil
+		})
+		seeded = err == nil
+		return err
+	}, watchlistRedisKey)
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Could not seed the watch list in RedisStore")
+		return false
+	}
+	return seeded
+}
@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// repositoryNamesRedisKey holds only names learned from verified webhooks, earlier versions learned them from any webhook
+const repositoryNamesRedisKey = "gsf:verified-repository-names"
+
+var ErrRepositoryNameHeld = errors.New("another repository holds the name")
+
+// RepositoryNames holds the full names (owner/name) of repositories by their numeric ID, learned from webhook payloads.
+// A name belongs to one repository, learning it for another fails with ErrRepositoryNameHeld.
+type RepositoryNames interface {
+	Learn(repositoryId string, fullName string) error
+	Name(repositoryId string) (string, bool)
+	ID(fullName string) (string, bool)
+	// Matching returns the IDs of the repositories whose full name matches the pattern
+	Matching(pattern string) []string
+}
+
+var Names RepositoryNames
+
+func initializeRepositoryNames(store EventStore) RepositoryNames {
+	if redisStore, ok := store.(*redisStore); ok {
+		return &redisRepositoryNames{redisClient: redisStore.redisClient}
+	}
+	return &inMemoryRepositoryNames{names: make(map[string]string)}
+}
+
+// IsRepositoryName tells if the repository is referred to by its full name rather than its ID
+func IsRepositoryName(repository string) bool {
+	return strings.Contains(repository, "/")
+}
+
+// IsRepositoryPattern tells if the repository is a glob pattern (myorg/*, myorg/service-*) matching full names
+func IsRepositoryPattern(repository string) bool {
+	return strings.ContainsAny(repository, "*?[")
+}
+
+// RepositoryMatches tells if the full name matches the pattern, ignoring case like GitHub does
+func RepositoryMatches(pattern string, fullName string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(fullName))
+	return err == nil && matched
+}
+
+// MatchingRepositories returns the IDs of the repositories a pattern matches, or the ID of the repository if it is none
+func MatchingRepositories(repository string) []string {
+	if Names == nil || !IsRepositoryPattern(repository) {
+		return []string{ResolveRepositoryID(repository)}
+	}
+	return Names.Matching(repository)
+}
+
+// ResolveRepositoryID returns the ID of a repository given by its full name, or the repository as is when it is an ID
+// or a name not seen in any webhook yet
+func ResolveRepositoryID(repository string) string {
+	if Names == nil || !IsRepositoryName(repository) {
+		return repository
+	}
+	if repositoryId, ok := Names.ID(repository); ok {
+		return repositoryId
+	}
+	return repository
+}
+
+// RepositoryAliases returns the ways the repository may be referred to, its ID and its full name when known
+func RepositoryAliases(repository string) []string {
+	aliases := []string{repository}
+	if Names == nil {
+		return aliases
+	}
+	if IsRepositoryName(repository) {
+		if repositoryId, ok := Names.ID(repository); ok {
+			aliases = append(aliases, repositoryId)
+		}
+	} else if name, ok := Names.Name(repository); ok {
+		aliases = append(aliases, name)
+	}
+	return aliases
+}
+
+// DescribeRepository shows the repository with its full name when known, for logs and info
+func DescribeRepository(repositoryId string) string {
+	if Names == nil || IsRepositoryName(repositoryId) {
+		return repositoryId
+	}
+	if name, ok := Names.Name(repositoryId); ok {
+		return fmt.Sprintf("%v (%v)", repositoryId, name)
+	}
+	return repositoryId
+}
+
+// LearnRepositoryName records the full name of a repository, which the caller must have verified, as names decide which
+// repositories clients may access. Servers learn them only from webhooks they verified with the HMAC, clients from the
+// names their server sends along with events. Only names of watched repositories, by their ID, their name, or a pattern
+// matching their name, are learned. Repositories watched, registered, or with a client key by their name are moved to
+// their ID, which is what events are cached under.
+func LearnRepositoryName(repositoryId string, fullName string) {
+	if fullName == "" || Names == nil {
+		return
+	}
+	if knownName, ok := Names.Name(repositoryId); ok && knownName == fullName {
+		return
+	}
+	watched := Repositories.WatchedRepositories()
+	// GitHub treats names case-insensitively
+	watchedByName := slices.ContainsFunc(watched, func(repository string) bool {
+		return strings.EqualFold(repository, fullName) || IsRepositoryPattern(repository) && RepositoryMatches(repository, fullName)
+	})
+	if !watchedByName && !Repositories.RepositoryIsWatched(repositoryId) {
+		return
+	}
+	if err := Names.Learn(repositoryId, fullName); err != nil {
+		sublogger.Warn().Err(err).Msgf("Could not learn the name %v of repository %v", fullName, repositoryId)
+		return
+	}
+	sublogger.Info().Msgf("Repository %v is named %v", repositoryId, fullName)
+
+	for _, watched := range watched {
+		if !strings.EqualFold(watched, fullName) {
+			continue
+		}
+		Repositories.AddRepository(repositoryId)
+		Repositories.RemoveRepository(watched)
+		if Registrations.IsRegistered(watched) {
+			Registrations.Register(repositoryId)
+			Registrations.Forget(watched)
+		}
+		if key, ok := ClientKeys.Lookup(watched); ok {
+			key.RepositoryID = repositoryId
+			if err := ClientKeys.Register(key); err != nil {
+				sublogger.Warn().Err(err).Msgf("Could not move the key of client %v to repository %v", key.ClientID, repositoryId)
+			}
+		}
+	}
+}
+
+// repositoryIdOf returns the ID of the repository with the full name
+func repositoryIdOf(names map[string]string, fullName string) (string, bool) {
+	for repositoryId, name := range names {
+		if strings.EqualFold(name, fullName) {
+			return repositoryId, true
+		}
+	}
+	return "", false
+}
+
+type inMemoryRepositoryNames struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func (i *inMemoryRepositoryNames) Learn(repositoryId string, fullName string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if holder, ok := repositoryIdOf(i.names, fullName); ok && holder != repositoryId {
+		return fmt.Errorf("%w: repository %v", ErrRepositoryNameHeld, holder)
+	}
+	i.names[repositoryId] = fullName
+	return nil
+}
+
+func (i *inMemoryRepositoryNames) Name(repositoryId string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	name, ok := i.names[repositoryId]
+	return name, ok
+}
+
+func (i *inMemoryRepositoryNames) ID(fullName string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return repositoryIdOf(i.names, fullName)
+}
+
+func (i *inMemoryRepositoryNames) Matching(pattern string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	matching := make([]string, 0)
+	for repositoryId, name := range i.names {
+		if RepositoryMatches(pattern, name) {
+			matching = append(matching, repositoryId)
+		}
+	}
+	slices.Sort(matching)
+	return matching
+}
+
+type redisRepositoryNames struct {
+	redisClient *redis.Client
+}
+
+func (r *redisRepositoryNames) Learn(repositoryId string, fullName string) error {
+	// watched, so another server cannot give the name to another repository in between
+	return r.redisClient.Watch(func(tx *redis.Tx) error {
+		names, err := tx.HGetAll(repositoryNamesRedisKey).Result()
+		if err != nil {
+			return fmt.Errorf("could not get repository names from RedisStore: %w", err)
+		}
+		if holder, ok := repositoryIdOf(names, fullName); ok && holder != repositoryId {
+			return fmt.Errorf("%w: repository %v", ErrRepositoryNameHeld, holder)
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(repositoryNamesRedisKey, repositoryId, fullName)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not store repository name in RedisStore: %w", err)
+		}
+		return nil
+	}, repositoryNamesRedisKey)
+}
+
+func (r *redisRepositoryNames) Name(repositoryId string) (string, bool) {
+	name, err := r.redisClient.HGet(repositoryNamesRedisKey, repositoryId).Result()
+	if err == redis.Nil {
+		return "", false
+	}
+	if err != nil {
+		sublogger.Warn().Err(err).Str("repo", repositoryId).Msg("Could not get repository name from RedisStore")
+		return "", false
+	}
+	return name, true
+}
+
+func (r *redisRepositoryNames) ID(fullName string) (string, bool) {
+	names, err := r.redisClient.HGetAll(repositoryNamesRedisKey).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Could not get repository names from RedisStore")
+		return "", false
+	}
+	return repositoryIdOf(names, fullName)
+}
+
+func (r *redisRepositoryNames) Matching(pattern string) []string {
+	matching := make([]string, 0)
+	names, err := r.redisClient.HGetAll(repositoryNamesRedisKey).Result()
+	if err != nil {
+		sublogger.Warn().Err(err).Msg("Could not get repository names from RedisStore")
+		return matching
+	}
+	for repositoryId, name := range names {
+		if RepositoryMatches(pattern, name) {
+			matching = append(matching, repositoryId)
+		}
+	}
+	slices.Sort(matching)
+	return matching
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	selfSignedCAValidity     = 10 * 365 * 24 * time.Hour
+	selfSignedServerValidity = 365 * 24 * time.Hour
+	// a self-signed server certificate is replaced at startup when it expires within this time
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+
+	caCertificateFile     = "ca.crt"
+	caKeyFile             = "ca.key"
+	serverCertificateFile = "server.crt"
+	serverKeyFile         = "server.key"
+)
+
+// SelfSignedCertificate makes sure the directory holds a CA and a server certificate for the hosts signed by it,
+// generating whichever is missing or about to expire. It returns the location of the server certificate and its key.
+// The CA is logged, so clients can pin it with their caFileLocation. A CA of which only the certificate or the key
+// is left is an error rather than being replaced.
+func SelfSignedCertificate(directory string, hosts []string) (certificateFileLocation string, certificateKeyFileLocation string, err error) {
+	if len(hosts) == 0 {
+		return "", "", fmt.Errorf("a self-signed certificate requires at least one host")
+	}
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return "", "", err
+	}
+	caFileLocation := filepath.Join(directory, caCertificateFile)
+	caKeyFileLocation := filepath.Join(directory, caKeyFile)
+	certificateFileLocation = filepath.Join(directory, serverCertificateFile)
+	certificateKeyFileLocation = filepath.Join(directory, serverKeyFile)
+
+	caExists, err := fileExists(caFileLocation)
+	if err != nil {
+		return "", "", fmt.Errorf("could not load self-signed CA: %w", err)
+	}
+	caKeyExists, err := fileExists(caKeyFileLocation)
+	if err != nil {
+		return "", "", fmt.Errorf("could not load self-signed CA: %w", err)
+	}
+	// replacing a CA of which only one half is left would silently break every client that pinned it
+	if caExists != caKeyExists {
+		present, missing := caFileLocation, caKeyFileLocation
+		if caKeyExists {
+			present, missing = caKeyFileLocation, caFileLocation
+		}
+		return "", "", fmt.Errorf("found %v but not %v, restore it or remove both to generate a new self-signed CA", present, missing)
+	}
+
+	var ca tls.Certificate
+	caGenerated := !caExists
+	if caGenerated {
+		log.Info().Msgf("Generating self-signed CA in %v", directory)
+		ca, err = generateCertificate(caFileLocation, caKeyFileLocation, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "Gitstafette Self-Signed CA"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			NotAfter:              time.Now().Add(selfSignedCAValidity),
+		}, nil)
+	} else {
+		ca, err = tls.LoadX509KeyPair(caFileLocation, caKeyFileLocation)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not load self-signed CA: %w", err)
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotAfter:    time.Now().Add(selfSignedServerValidity),
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	// a new CA did not sign the certificate we have, so clients trusting the new CA would reject it
+	if caGenerated || !selfSignedCertificateUsable(certificateFileLocation, &ca, template) {
+		log.Info().Msgf("Generating self-signed server certificate for %v", hosts)
+		if _, err := generateCertificate(certificateFileLocation, certificateKeyFileLocation, template, &ca); err != nil {
+			return "", "", fmt.Errorf("could not generate self-signed server certificate: %w", err)
+		}
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	fingerprint := sha256.Sum256(ca.Certificate[0])
+	log.Info().Str("caCertificate", string(caPEM)).
+		Msgf("Serving a self-signed certificate, clients must trust the CA %v (SHA-256 %v)", caFileLocation, hex.EncodeToString(fingerprint[:]))
+	return certificateFileLocation, certificateKeyFileLocation, nil
+}
+
+func fileExists(fileLocation string) (bool, error) {
+	_, err := os.Stat(fileLocation)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// selfSignedCertificateUsable tells if the server certificate is signed by the CA, does not expire soon,
+// and is for the hosts of the template
+func selfSignedCertificateUsable(certificateFileLocation string, ca *tls.Certificate, template *x509.Certificate) bool {
+	content, err := os.ReadFile(certificateFileLocation)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return false
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(selfSignedRenewBefore).After(certificate.NotAfter) {
+		return false
+	}
+	caCertificate, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil || certificate.CheckSignatureFrom(caCertificate) != nil {
+		log.Info().Msg("Self-signed server certificate is not signed by the current CA")
+		return false
+	}
+	sameIPAddresses := slices.EqualFunc(certificate.IPAddresses, template.IPAddresses, func(a net.IP, b net.IP) bool { return a.Equal(b) })
+	if !slices.Equal(certificate.DNSNames, template.DNSNames) || !sameIPAddresses {
+		log.Info().Msgf("Self-signed server certificate is for %v %v, not for the configured hosts", certificate.DNSNames, certificate.IPAddresses)
+		return false
+	}
+	return true
+}
+
+// generateCertificate creates a new key and certificate from the template, signed by the parent or self-signed without one
+func generateCertificate(certificateFileLocation string, keyFileLocation string, template *x509.Certificate, parent *tls.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.SerialNumber = serialNumber
+	template.NotBefore = time.Now().Add(-time.Hour)
+
+	parentCertificate, signer := template, interface{}(key)
+	if parent != nil {
+		parentCertificate, err = x509.ParseCertificate(parent.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		signer = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, signer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	encodedKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encodedKey})
+	if err := os.WriteFile(keyFileLocation, keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certificateFileLocation, certificatePEM, 0o644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certificatePEM, keyPEM)
+}
+
+// NewACMEManager obtains and renews certificates for the hosts from an ACME CA such as Let's Encrypt.
+// The HTTP-01 challenges must be served on port 80 with the manager's HTTPHandler.
+func NewACMEManager(hosts []string, cacheDirectory string, email string, directoryURL string) (*autocert.Manager, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("ACME requires at least one host")
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDirectory),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	log.Info().Msgf("Obtaining TLS certificates for %v via ACME", hosts)
+	return manager, nil
+}
+
+// NewACMETLSConfig creates the server TLS configuration serving the certificates of the ACME manager,
+// verifying client certificates if a CA is set like NewTLSConfig does
+func NewACMETLSConfig(ctx context.Context, manager *autocert.Manager, caFileLocation string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if caFileLocation != "" {
+		var err error
+		tlsConfig, err = NewTLSConfig(ctx, caFileLocation, "", "", true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig.GetCertificate = manager.GetCertificate
+	return tlsConfig, nil
+}
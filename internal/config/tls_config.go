@@ -1,63 +1,246 @@
 package config
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"os"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func NewTLSConfig(caFileLocation string, certificateFileLocation string, certificateKeyFileLocation string, isServer bool) (*tls.Config, error) {
+// ReloadInterval is how often the certificate, key and CA files are checked for changes
+const ReloadInterval = 30 * time.Second
+
+// NewTLSConfig creates the TLS configuration for the server or the client. The certificate, key and CA files
+// are watched until the context is done, when they change the new certificates are used for new connections,
+// existing connections are kept.
+func NewTLSConfig(ctx context.Context, caFileLocation string, certificateFileLocation string, certificateKeyFileLocation string, isServer bool) (*tls.Config, error) {
 	if certificateFileLocation == "" && certificateKeyFileLocation == "" && caFileLocation == "" {
 		return nil, nil
 	}
-	var err error
 	tlsConfig := &tls.Config{}
 
-	if certificateFileLocation != "" && certificateKeyFileLocation != "" {
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(
-			certificateFileLocation,
-			certificateKeyFileLocation,
-		)
+	files := &tlsFiles{
+		caFileLocation:             caFileLocation,
+		certificateFileLocation:    certificateFileLocation,
+		certificateKeyFileLocation: certificateKeyFileLocation,
+		systemRoots:                !isServer,
+		modTimes:                   make(map[string]time.Time),
+	}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+
+	if files.hasCertificate() {
+		if isServer {
+			tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return files.currentCertificate(), nil
+			}
+		} else {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return files.currentCertificate(), nil
+			}
+		}
 	} else {
 		log.Warn().Msg("Did not find a certificate with a key, no TLS certs")
 	}
 
 	if caFileLocation != "" {
-		b, err := os.ReadFile(caFileLocation)
+		if isServer {
+			tlsConfig.ClientCAs = files.currentCA()
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			// TODO: should we configure the config name?
+			tlsConfig.ServerName = "gitstafette-server"
+			// the client CAs can only be swapped by handing out a new config for every connection, which copies the
+			// session ticket keys set here, so sessions resume across connections
+			var sessionTicketKey [32]byte
+			if _, err := rand.Read(sessionTicketKey[:]); err != nil {
+				return nil, fmt.Errorf("could not create session ticket key: %w", err)
+			}
+			tlsConfig.SetSessionTicketKeys([][32]byte{sessionTicketKey})
+			tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return files.serverConfig(tlsConfig), nil
+			}
+			log.Info().Msg("Configuring TLS for Server")
+		} else {
+			tlsConfig.RootCAs = files.currentCA()
+			// the server certificate is verified against the current root CAs, so they can be swapped
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = files.verifyServer
+			log.Info().Msg("Configuring TLS for Client")
+		}
+	} else {
+		log.Warn().Msg("Did not find a CA cert, no TLS RootCA set")
+	}
+
+	go files.watch(ctx, ReloadInterval)
+	return tlsConfig, nil
+}
+
+// tlsFiles holds the certificate and CA last loaded from their files
+type tlsFiles struct {
+	caFileLocation             string
+	certificateFileLocation    string
+	certificateKeyFileLocation string
+	// systemRoots adds the system roots to the CA, which a client may trust for the server but a server must not
+	// trust for clients, as any publicly issued certificate would then identify a client
+	systemRoots bool
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	ca          *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+func (t *tlsFiles) hasCertificate() bool {
+	return t.certificateFileLocation != "" && t.certificateKeyFileLocation != ""
+}
+
+func (t *tlsFiles) currentCertificate() *tls.Certificate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.certificate
+}
+
+func (t *tlsFiles) currentCA() *x509.CertPool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ca
+}
+
+func (t *tlsFiles) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !t.changed() {
+			continue
+		}
+		if err := t.load(); err != nil {
+			log.Warn().Err(err).Msg("Could not reload TLS certificates, keep using the current ones")
+			continue
+		}
+		log.Info().Msg("Reloaded TLS certificates")
+	}
+}
+
+// changed tells if any of the files was modified since it was last loaded
+func (t *tlsFiles) changed() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, fileLocation := range t.fileLocations() {
+		info, err := os.Stat(fileLocation)
 		if err != nil {
-			return nil, err
+			continue
+		}
+		if !info.ModTime().Equal(t.modTimes[fileLocation]) {
+			return true
 		}
+	}
+	return false
+}
+
+func (t *tlsFiles) fileLocations() []string {
+	fileLocations := make([]string, 0, 3)
+	if t.hasCertificate() {
+		fileLocations = append(fileLocations, t.certificateFileLocation, t.certificateKeyFileLocation)
+	}
+	if t.caFileLocation != "" {
+		fileLocations = append(fileLocations, t.caFileLocation)
+	}
+	return fileLocations
+}
+
+// load reads all files, only replacing the current certificates if they are all valid
+func (t *tlsFiles) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, fileLocation := range t.fileLocations() {
+		info, err := os.Stat(fileLocation)
+		if err != nil {
+			return err
+		}
+		modTimes[fileLocation] = info.ModTime()
+	}
+
+	var certificate *tls.Certificate
+	if t.hasCertificate() {
+		keyPair, err := tls.LoadX509KeyPair(t.certificateFileLocation, t.certificateKeyFileLocation)
+		if err != nil {
+			return err
+		}
+		certificate = &keyPair
+	}
 
-		ca, err := x509.SystemCertPool()
+	var ca *x509.CertPool
+	if t.caFileLocation != "" {
+		b, err := os.ReadFile(t.caFileLocation)
 		if err != nil {
-			log.Warn().Err(err).Msg("cannot load root CA certs")
+			return err
+		}
+
+		ca = x509.NewCertPool()
+		if t.systemRoots {
+			ca, err = x509.SystemCertPool()
+			if err != nil {
+				log.Warn().Err(err).Msg("cannot load root CA certs")
+				ca = x509.NewCertPool()
+			}
 		}
 		ok := ca.AppendCertsFromPEM(b)
 
 		if !ok {
-			return nil, fmt.Errorf(
+			return fmt.Errorf(
 				"failed to parse root certificate: %q",
-				caFileLocation,
+				t.caFileLocation,
 			)
 		}
+	}
 
-		if isServer {
-			tlsConfig.ClientCAs = ca
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-			// TODO: should we configure the config name?
-			tlsConfig.ServerName = "gitstafette-server"
-			log.Info().Msg("Configuring TLS for Server")
-		} else {
-			tlsConfig.RootCAs = ca
-			log.Info().Msg("Configuring TLS for Client")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.certificate = certificate
+	t.ca = ca
+	t.modTimes = modTimes
+	return nil
+}
+
+// serverConfig returns the config for a new server connection, with the current client CAs
+func (t *tlsFiles) serverConfig(base *tls.Config) *tls.Config {
+	connectionConfig := base.Clone()
+	connectionConfig.GetConfigForClient = nil
+	connectionConfig.ClientCAs = t.currentCA()
+	// the GRPC credentials add h2 to a copy of the base config, which the copy made here does not have
+	for _, protocol := range []string{"h2", "http/1.1"} {
+		if !slices.Contains(connectionConfig.NextProtos, protocol) {
+			connectionConfig.NextProtos = append(connectionConfig.NextProtos, protocol)
 		}
-	} else {
-		log.Warn().Msg("Did not find a CA cert, no TLS RootCA set")
 	}
+	return connectionConfig
+}
 
-	return tlsConfig, err
+// verifyServer does the verification of the server certificate that InsecureSkipVerify disables, against the current root CAs
+func (t *tlsFiles) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("server did not present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         t.currentCA(),
+		Intermediates: intermediates,
+		DNSName:       state.ServerName,
+	})
+	return err
 }
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions are the versions we accept as minimum, TLS 1.0 and 1.1 are deprecated (RFC 8996)
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as 1.2 or 1.3 to its TLS constant
+func ParseTLSVersion(version string) (uint16, error) {
+	tlsVersion, ok := tlsVersions[strings.TrimSpace(version)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.2 or 1.3", version)
+	}
+	return tlsVersion, nil
+}
+
+// ParseCipherSuites converts comma separated cipher suite names, such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, to their ids.
+// Only suites Go considers secure are accepted, TLS 1.3 suites are not configurable.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0)
+	for _, name := range strings.Split(names, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// WithoutClientCertificates returns a copy of the server configuration that does not ask for client certificates,
+// for the webhook endpoint which is called by the likes of GitHub
+func WithoutClientCertificates(tlsConfig *tls.Config) *tls.Config {
+	return WithClientAuth(tlsConfig, tls.NoClientCert)
+}
+
+// WithClientAuth returns a copy of the server configuration for HTTP servers, with a different client certificate policy
+func WithClientAuth(tlsConfig *tls.Config, clientAuth tls.ClientAuthType) *tls.Config {
+	httpConfig := tlsConfig.Clone()
+	httpConfig.ClientAuth = clientAuth
+	// the HTTP server only enables HTTP/2 when its own configuration offers it
+	if len(httpConfig.NextProtos) == 0 {
+		httpConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if getConfigForClient := tlsConfig.GetConfigForClient; getConfigForClient != nil {
+		httpConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			connectionConfig, err := getConfigForClient(hello)
+			if connectionConfig != nil {
+				connectionConfig.ClientAuth = clientAuth
+			}
+			return connectionConfig, err
+		}
+	}
+	return httpConfig
+}
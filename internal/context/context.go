@@ -3,13 +3,16 @@ package context
 import (
 	"context"
 	gitstafette_v1 "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/auth"
 	"github.com/labstack/echo/v4"
 )
 
 type GitstafetteContext struct {
 	echo.Context
-	WebhookHMAC string
-	Relay       *gitstafette_v1.RelayConfig
+	WebhookHMAC    string
+	MaxPayloadSize int64 // in bytes, zero or less means unlimited
+	Relay          *gitstafette_v1.RelayConfig
+	Authorizer     *auth.Authorizer
 }
 
 type ServiceContext struct {
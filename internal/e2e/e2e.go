@@ -0,0 +1,149 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Algorithm identifies the scheme used to encrypt event bodies for a client:
+// an ephemeral X25519 key agreement, HKDF-SHA256 key derivation and AES-256-GCM.
+const Algorithm = "X25519-HKDF-SHA256-AES256GCM"
+
+const (
+	hkdfInfo       = "gitstafette end-to-end payload encryption v1"
+	privateKeyType = "PRIVATE KEY"
+)
+
+var sublogger zerolog.Logger
+
+func init() {
+	sublogger = log.With().Str("component", "e2e").Logger()
+}
+
+// KeyID returns a short fingerprint of a public key, so both sides can tell which key was used
+func KeyID(publicKey []byte) string {
+	digest := sha256.Sum256(publicKey)
+	return hex.EncodeToString(digest[:8])
+}
+
+// ParsePublicKey validates a raw X25519 public key
+func ParsePublicKey(publicKey []byte) (*ecdh.PublicKey, error) {
+	return ecdh.X25519().NewPublicKey(publicKey)
+}
+
+// LoadOrCreatePrivateKey reads the PEM encoded private key at the location, generating and storing a new one if there is none
+func LoadOrCreatePrivateKey(keyFileLocation string) (*ecdh.PrivateKey, error) {
+	content, err := os.ReadFile(keyFileLocation)
+	if errors.Is(err, os.ErrNotExist) {
+		return createPrivateKey(keyFileLocation)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != privateKeyType {
+		return nil, fmt.Errorf("no %s found in %q", privateKeyType, keyFileLocation)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsedKey.(*ecdh.PrivateKey)
+	if !ok || privateKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("key in %q is not an X25519 private key", keyFileLocation)
+	}
+	return privateKey, nil
+}
+
+func createPrivateKey(keyFileLocation string) (*ecdh.PrivateKey, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encodedKey, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: privateKeyType, Bytes: encodedKey})
+	if err := os.WriteFile(keyFileLocation, content, 0o600); err != nil {
+		return nil, err
+	}
+	sublogger.Info().Msgf("Generated new end-to-end encryption key %v in %v", KeyID(privateKey.PublicKey().Bytes()), keyFileLocation)
+	return privateKey, nil
+}
+
+// Seal encrypts the plaintext so only the holder of the private key belonging to publicKey can read it.
+// It returns the ephemeral public key the recipient needs to open the ciphertext.
+func Seal(publicKey []byte, plaintext []byte, additionalData []byte) (ephemeralPublicKey []byte, ciphertext []byte, err error) {
+	recipient, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralPublicKey = ephemeral.PublicKey().Bytes()
+	aead, err := newAEAD(sharedSecret, ephemeralPublicKey, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return ephemeralPublicKey, aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts a ciphertext created by Seal
+func Open(privateKey *ecdh.PrivateKey, ephemeralPublicKey []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	ephemeral, err := ParsePublicKey(ephemeralPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(sharedSecret, ephemeralPublicKey, privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newAEAD(sharedSecret []byte, ephemeralPublicKey []byte, recipientPublicKey []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPublicKey...), recipientPublicKey...)
+	key, err := hkdf.Key(sha256.New, sharedSecret, salt, hkdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,86 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte(`{"ref":"refs/heads/main"}`)
+	additionalData := []byte("delivery-1")
+
+	ephemeralPublicKey, ciphertext, err := Seal(privateKey.PublicKey().Bytes(), plaintext, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatal("ciphertext contains the plaintext")
+	}
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[len(flipped)-1] ^= 0x01
+	tests := []struct {
+		name               string
+		privateKey         *ecdh.PrivateKey
+		ephemeralPublicKey []byte
+		ciphertext         []byte
+		additionalData     []byte
+		valid              bool
+	}{
+		{name: "recipient", privateKey: privateKey, ephemeralPublicKey: ephemeralPublicKey, ciphertext: ciphertext, additionalData: additionalData, valid: true},
+		{name: "other recipient", privateKey: otherKey, ephemeralPublicKey: ephemeralPublicKey, ciphertext: ciphertext, additionalData: additionalData},
+		{name: "other event", privateKey: privateKey, ephemeralPublicKey: ephemeralPublicKey, ciphertext: ciphertext, additionalData: []byte("delivery-2")},
+		{name: "tampered ciphertext", privateKey: privateKey, ephemeralPublicKey: ephemeralPublicKey, ciphertext: flipped, additionalData: additionalData},
+		{name: "other ephemeral key", privateKey: privateKey, ephemeralPublicKey: otherKey.PublicKey().Bytes(), ciphertext: ciphertext, additionalData: additionalData},
+		{name: "truncated ciphertext", privateKey: privateKey, ephemeralPublicKey: ephemeralPublicKey, ciphertext: ciphertext[:4], additionalData: additionalData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := Open(tt.privateKey, tt.ephemeralPublicKey, tt.ciphertext, tt.additionalData)
+			if tt.valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Errorf("Open() = %q, want %q", opened, plaintext)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("Open() = %q, want an error", opened)
+			}
+		})
+	}
+}
+
+func TestSealRejectsInvalidPublicKey(t *testing.T) {
+	if _, _, err := Seal([]byte("too short"), []byte("body"), nil); err == nil {
+		t.Error("Seal() with an invalid public key succeeded")
+	}
+}
+
+func TestLoadOrCreatePrivateKey(t *testing.T) {
+	keyFileLocation := filepath.Join(t.TempDir(), "e2e.key")
+	created, err := LoadOrCreatePrivateKey(keyFileLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreatePrivateKey(keyFileLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(loaded) {
+		t.Error("loaded key differs from the created key")
+	}
+}
@@ -0,0 +1,216 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/joostvdg/gitstafette/internal/auth"
+	"github.com/joostvdg/gitstafette/internal/otel_util"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// healthMethodPrefix is never authenticated, so probes keep working
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// methodPermissions lists the permission each RPC requires on the repository of its request,
+// RPCs not listed here only require an authenticated caller
+var methodPermissions = map[string]auth.Permission{
+	"/gitstafette.v1.Gitstafette/FetchWebhookEvents":       auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/WebhookEventStatus":       auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/WebhookEventStatuses":     auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/RegisterClientKey":        auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/RegisterRepository":       auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/AcknowledgeWebhookEvents": auth.PermissionFetch,
+	"/gitstafette.v1.Gitstafette/WebhookEventPush":         auth.PermissionPush,
+}
+
+type clientRequest interface {
+	GetClientId() string
+}
+
+// pushRequest covers the misspelled client id of WebhookEventPushRequest
+type pushRequest interface {
+	GetCliendId() string
+}
+
+type repositoryRequest interface {
+	GetRepositoryId() string
+}
+
+// multiRepositoryRequest covers requests for several repositories, each of which must be allowed
+type multiRepositoryRequest interface {
+	GetRepositoryIds() []string
+}
+
+var (
+	rejectedRequests     otelmetric.Int64Counter
+	rejectedRequestsOnce sync.Once
+)
+
+// UnaryAuthInterceptor authenticates the caller and checks its access to the repository of the request
+func UnaryAuthInterceptor(authorizer *auth.Authorizer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !authorizer.Enabled() || strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(ctx, req)
+		}
+		identity, err := authenticate(ctx, authorizer)
+		if err != nil {
+			return nil, reject(ctx, info.FullMethod, nil, err)
+		}
+		if err := authorizeRequest(authorizer, identity, info.FullMethod, req); err != nil {
+			return nil, reject(ctx, info.FullMethod, identity, err)
+		}
+		return handler(auth.ContextWithIdentity(ctx, identity), req)
+	}
+}
+
+// StreamAuthInterceptor authenticates the caller and checks its access to the repository of each received message
+func StreamAuthInterceptor(authorizer *auth.Authorizer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !authorizer.Enabled() || strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(srv, ss)
+		}
+		identity, err := authenticate(ss.Context(), authorizer)
+		if err != nil {
+			return reject(ss.Context(), info.FullMethod, nil, err)
+		}
+		return handler(srv, &authorizedStream{
+			ServerStream: ss,
+			ctx:          auth.ContextWithIdentity(ss.Context(), identity),
+			authorizer:   authorizer,
+			identity:     identity,
+			fullMethod:   info.FullMethod,
+		})
+	}
+}
+
+// authorizedStream checks every request message, as the stream interceptor runs before the request is received
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	authorizer *auth.Authorizer
+	identity   *auth.Identity
+	fullMethod string
+}
+
+func (a *authorizedStream) Context() context.Context {
+	return a.ctx
+}
+
+func (a *authorizedStream) RecvMsg(m interface{}) error {
+	if err := a.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if err := authorizeRequest(a.authorizer, a.identity, a.fullMethod, m); err != nil {
+		return reject(a.ctx, a.fullMethod, a.identity, err)
+	}
+	return nil
+}
+
+// authenticate uses the bearer token when there is one, otherwise the verified client certificate. With both,
+// the token must belong to the client the certificate names.
+func authenticate(ctx context.Context, authorizer *auth.Authorizer) (*auth.Identity, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok && len(md["authorization"]) > 0 {
+		token := strings.TrimPrefix(md["authorization"][0], "Bearer ")
+		identity, err := authorizer.AuthenticateToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return authorizer.BindCertificate(identity, peerCertificate(ctx))
+	}
+	if authorizer.CertificateIdentityEnabled() {
+		return authorizer.AuthenticateCertificate(peerCertificate(ctx))
+	}
+	return nil, fmt.Errorf("%w: missing authorization metadata", auth.ErrUnauthenticated)
+}
+
+// peerCertificate returns the client certificate, only if it was verified against the client CA
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+func authorizeRequest(authorizer *auth.Authorizer, identity *auth.Identity, fullMethod string, req interface{}) error {
+	clientId := ""
+	if request, ok := req.(clientRequest); ok {
+		clientId = request.GetClientId()
+	} else if request, ok := req.(pushRequest); ok {
+		clientId = request.GetCliendId()
+	}
+	repositoryId := ""
+	permission, requiresPermission := methodPermissions[fullMethod]
+	if request, ok := req.(repositoryRequest); ok && requiresPermission {
+		repositoryId = request.GetRepositoryId()
+	} else if requiresPermission {
+		// a request without a repository covers all of them
+		repositoryId = auth.AnyRepository
+	}
+	if request, ok := req.(multiRepositoryRequest); ok && requiresPermission {
+		for _, additionalRepositoryId := range request.GetRepositoryIds() {
+			if err := authorizer.Authorize(identity, permission, clientId, additionalRepositoryId); err != nil {
+				return err
+			}
+		}
+	}
+	return authorizer.Authorize(identity, permission, clientId, repositoryId)
+}
+
+// reject logs and counts a refused request, and converts the error into a GRPC status
+func reject(ctx context.Context, fullMethod string, identity *auth.Identity, err error) error {
+	code := codes.Unauthenticated
+	if errors.Is(err, auth.ErrPermissionDenied) {
+		code = codes.PermissionDenied
+	}
+	caller := "<unauthenticated>"
+	if identity != nil {
+		caller = identity.String()
+	}
+	log.Warn().
+		Str("method", fullMethod).
+		Str("caller", caller).
+		Str("peer", otel_util.PeerFromCtx(ctx)).
+		Err(err).
+		Msg("Rejected GRPC request")
+
+	if otel_util.IsOTelEnabled() {
+		rejectedRequestsOnce.Do(func() {
+			counter, counterErr := otel.GetMeterProvider().Meter("gitstafette").Int64Counter(
+				"grpc_requests_rejected",
+				otelmetric.WithDescription("Number of GRPC requests rejected by authentication or authorization"),
+			)
+			if counterErr != nil {
+				log.Warn().Err(counterErr).Msg("Encountered an error when creating counter")
+				return
+			}
+			rejectedRequests = counter
+		})
+		if rejectedRequests != nil {
+			rejectedRequests.Add(ctx, 1, otelmetric.WithAttributes(
+				attribute.String("method", fullMethod),
+				attribute.String("code", code.String()),
+			))
+		}
+	}
+	return status.Error(code, err.Error())
+}
@@ -6,18 +6,11 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/status"
-	"os"
-	"strings"
+	"google.golang.org/grpc/encoding/gzip"
+	"slices"
 	"time"
 )
 
-const (
-	envOauthToken = "OAUTH_TOKEN"
-)
-
 type WrappedStream struct {
 	grpc.ServerStream
 }
@@ -48,44 +41,13 @@ func EventsServerStreamInterceptor(srv interface{}, serverStream grpc.ServerStre
 	return handler(srv, serverStream)
 }
 
-func ValidateToken(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	log.Info().Msg("Validating token for GRPC Stream Request")
-	//ctx := ss.Context()
-	//newCtx, span := otel.Tracer("Server").Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer))
-	//defer span.End()
-	//span.SetAttributes(attribute.String("grpc.service", info.FullMethod))
-	//span.SetAttributes(attribute.String("grpc.stream.type", "server"))
-	//span.AddEvent("Validating token for GRPC Stream Request")
-
-	oauthToken, oauthOk := os.LookupEnv(envOauthToken)
-	if oauthOk {
-		log.Printf("Validating token for GRPC Stream Request -> TOKEN FOUND")
-		md, ok := metadata.FromIncomingContext(ss.Context())
-		if !ok {
-			errorMessage := "missing metadata when validating OAuth Token"
-			log.Warn().Msg(errorMessage)
-			return status.Error(codes.InvalidArgument, errorMessage)
-		}
-
-		if !valid(md["authorization"], oauthToken) {
-			errorMessage := "OAuth Token Missing Or Not Valid"
-			log.Warn().Msg(errorMessage)
-			return status.Error(codes.Unauthenticated, errorMessage)
-		} else {
-			log.Printf("Validating token for GRPC Stream Request -> TOKEN VALID")
+// NegotiateCompression compresses the messages a stream sends with gzip, if the client supports it
+func NegotiateCompression(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	supportedCompressors, err := grpc.ClientSupportedCompressors(ss.Context())
+	if err == nil && slices.Contains(supportedCompressors, gzip.Name) {
+		if err := grpc.SetSendCompressor(ss.Context(), gzip.Name); err != nil {
+			log.Warn().Err(err).Msg("Could not enable gzip compression for GRPC Stream")
 		}
-	} else {
-		log.Warn().Msg("Validating token for GRPC Stream Request -> TOKEN MISSING")
 	}
-
 	return handler(srv, ss)
 }
-
-func valid(authorization []string, expectedToken string) bool {
-	if len(authorization) < 1 {
-		return false
-	}
-	receivedToken := strings.TrimPrefix(authorization[0], "Bearer ")
-	// If you have more than one client then you will have to update this line.
-	return receivedToken == expectedToken
-}
@@ -0,0 +1,583 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/cors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web+proto"
+	grpcWebContentTypeBase = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	connectUnaryJSON     = "application/json"
+	connectUnaryProto    = "application/proto"
+	connectStreamJSON    = "application/connect+json"
+	connectStreamProto   = "application/connect+proto"
+	connectTimeoutHeader = "Connect-Timeout-Ms"
+
+	// the flags of the length prefixed frames used by both gRPC-Web and Connect streaming
+	frameHeaderSize = 5
+	frameTrailers   = 0x80
+	frameEndStream  = 0x02
+
+	// the largest Connect request message we accept
+	maxConnectRequestSize = 4 * 1024 * 1024
+)
+
+// connectCodes are the Connect names and HTTP status codes of the GRPC status codes
+var connectCodes = map[codes.Code]struct {
+	name       string
+	httpStatus int
+}{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+// WebHandler serves the GRPC services to browsers and HTTP/1.1 clients such as curl, with the gRPC-Web and Connect protocols.
+// Both are translated to regular GRPC calls, so the same interceptors apply.
+type WebHandler struct {
+	grpcServer    *grpc.Server
+	originAllowed func(origin string) bool
+	cors          *cors.Cors
+	methods       map[string]*webMethod
+}
+
+type webMethod struct {
+	descriptor    protoreflect.MethodDescriptor
+	serverStreams bool
+}
+
+// NewWebHandler creates the gRPC-Web and Connect handler for all services of the server.
+// Browsers from the allowed origins may call them, "*" allows any origin.
+func NewWebHandler(grpcServer *grpc.Server, allowedOrigins []string) *WebHandler {
+	originAllowed := func(origin string) bool {
+		return slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin)
+	}
+	handler := &WebHandler{
+		grpcServer:    grpcServer,
+		originAllowed: originAllowed,
+		cors: cors.New(cors.Options{
+			AllowOriginFunc: originAllowed,
+			AllowedMethods:  []string{http.MethodPost},
+			AllowedHeaders:  []string{"*"},
+			ExposedHeaders:  []string{"Grpc-Status", "Grpc-Message"},
+			// clients authenticate with a bearer token, browser credentials such as cookies are never needed,
+			// and must not be sent along from any origin
+			AllowCredentials: false,
+			MaxAge:           int(10 * time.Minute / time.Second),
+		}),
+		methods: make(map[string]*webMethod),
+	}
+
+	for serviceName, serviceInfo := range grpcServer.GetServiceInfo() {
+		descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Service %v is not available for Connect", serviceName)
+			continue
+		}
+		service, ok := descriptor.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		for _, method := range serviceInfo.Methods {
+			// Connect needs HTTP/2 for client streams, which GRPC clients use anyway
+			if method.IsClientStream {
+				continue
+			}
+			methodDescriptor := service.Methods().ByName(protoreflect.Name(method.Name))
+			if methodDescriptor == nil {
+				continue
+			}
+			handler.methods["/"+serviceName+"/"+method.Name] = &webMethod{
+				descriptor:    methodDescriptor,
+				serverStreams: method.IsServerStream,
+			}
+		}
+	}
+	log.Info().Msgf("Serving %d GRPC methods with gRPC-Web and Connect", len(handler.methods))
+	return handler
+}
+
+// Handles tells if the request is a gRPC-Web or Connect request, or a CORS pre-flight for one
+func (w *WebHandler) Handles(r *http.Request) bool {
+	if isGRPCWebRequest(r) {
+		return true
+	}
+	if _, ok := w.methods[r.URL.Path]; !ok {
+		return false
+	}
+	return r.Method == http.MethodOptions || (r.Method == http.MethodPost && connectContentType(r) != "")
+}
+
+func (w *WebHandler) ServeHTTP(resp http.ResponseWriter, r *http.Request) {
+	// a browser on another origin may send the request even though it may not read the response
+	if origin := r.Header.Get("Origin"); origin != "" && !w.originAllowed(origin) {
+		http.Error(resp, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if isGRPCWebRequest(r) {
+		w.cors.Handler(http.HandlerFunc(w.serveGRPCWeb)).ServeHTTP(resp, r)
+		return
+	}
+	w.cors.Handler(http.HandlerFunc(w.serveConnect)).ServeHTTP(resp, r)
+}
+
+func isGRPCWebRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), grpcWebContentTypeBase)
+}
+
+// serveGRPCWeb passes a gRPC-Web call to the GRPC server as a GRPC call. The messages are framed the same,
+// only the trailers are sent as a last frame, as browsers cannot read HTTP trailers.
+func (w *WebHandler) serveGRPCWeb(resp http.ResponseWriter, r *http.Request) {
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	subtype := strings.TrimPrefix(contentType, grpcWebContentTypeBase)
+	if text {
+		subtype = strings.TrimPrefix(contentType, grpcWebTextContentType)
+	}
+
+	grpcRequest := r.Clone(r.Context())
+	grpcRequest.ProtoMajor, grpcRequest.ProtoMinor, grpcRequest.Proto = 2, 0, "HTTP/2"
+	grpcRequest.Header.Set("Content-Type", "application/grpc"+subtype)
+	grpcRequest.Header.Del("Content-Length")
+	grpcRequest.ContentLength = -1
+	if text {
+		grpcRequest.Body = io.NopCloser(&textReader{reader: bufio.NewReader(r.Body)})
+	}
+
+	response := &grpcWebResponse{
+		resp:        resp,
+		header:      make(http.Header),
+		contentType: r.Header.Get("Content-Type"),
+		text:        text,
+	}
+	w.grpcServer.ServeHTTP(response, grpcRequest)
+	response.finish()
+}
+
+// textReader decodes a grpc-web-text body one base64 quantum at a time, as clients may encode every message on its
+// own, each with its padding, which a single base64 decoder over the whole body rejects
+type textReader struct {
+	reader  *bufio.Reader
+	decoded []byte
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	for len(t.decoded) == 0 {
+		var quantum [4]byte
+		if _, err := io.ReadFull(t.reader, quantum[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, fmt.Errorf("grpc-web-text body is not valid base64: %w", err)
+			}
+			return 0, err
+		}
+		decoded := make([]byte, 3)
+		n, err := base64.StdEncoding.Decode(decoded, quantum[:])
+		if err != nil {
+			return 0, fmt.Errorf("grpc-web-text body is not valid base64: %w", err)
+		}
+		t.decoded = decoded[:n]
+	}
+	n := copy(p, t.decoded)
+	t.decoded = t.decoded[n:]
+	return n, nil
+}
+
+// grpcWebResponse is the response writer of the GRPC server, converting its response into a gRPC-Web response
+type grpcWebResponse struct {
+	resp        http.ResponseWriter
+	header      http.Header
+	contentType string
+	text        bool
+
+	status int
+}
+
+func (g *grpcWebResponse) Header() http.Header {
+	return g.header
+}
+
+// WriteHeader sends the headers, leaving out the trailers the GRPC server declares
+func (g *grpcWebResponse) WriteHeader(status int) {
+	if g.status != 0 {
+		return
+	}
+	g.status = status
+	declared := g.declaredTrailers()
+	for key, values := range g.header {
+		if key == "Trailer" || slices.Contains(declared, key) || strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		g.resp.Header()[key] = values
+	}
+	if status == http.StatusOK {
+		g.resp.Header().Set("Content-Type", g.contentType)
+	}
+	g.resp.WriteHeader(status)
+}
+
+func (g *grpcWebResponse) Write(b []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	if g.text && g.status == http.StatusOK {
+		if _, err := g.resp.Write([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return g.resp.Write(b)
+}
+
+func (g *grpcWebResponse) Flush() {
+	g.WriteHeader(http.StatusOK)
+	if flusher, ok := g.resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (g *grpcWebResponse) declaredTrailers() []string {
+	declared := make([]string, 0)
+	for _, value := range g.header.Values("Trailer") {
+		for _, key := range strings.Split(value, ",") {
+			declared = append(declared, http.CanonicalHeaderKey(strings.TrimSpace(key)))
+		}
+	}
+	return declared
+}
+
+// finish sends the trailers as the last frame, unless the GRPC server refused the call before it began
+func (g *grpcWebResponse) finish() {
+	g.WriteHeader(http.StatusOK)
+	if g.status != http.StatusOK {
+		return
+	}
+	var trailers bytes.Buffer
+	for key, values := range g.header {
+		name, undeclared := strings.CutPrefix(key, http.TrailerPrefix)
+		if !undeclared && !slices.Contains(g.declaredTrailers(), key) {
+			continue
+		}
+		for _, value := range values {
+			fmt.Fprintf(&trailers, "%s: %s\r\n", strings.ToLower(name), value)
+		}
+	}
+	_, _ = g.Write(frame(frameTrailers, trailers.Bytes()))
+	g.Flush()
+}
+
+func connectContentType(r *http.Request) string {
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	switch strings.TrimSpace(strings.ToLower(contentType)) {
+	case connectUnaryJSON:
+		return connectUnaryJSON
+	case connectUnaryProto:
+		return connectUnaryProto
+	case connectStreamJSON:
+		return connectStreamJSON
+	case connectStreamProto:
+		return connectStreamProto
+	}
+	return ""
+}
+
+// serveConnect translates a Connect call into a gRPC-Web call, and its response back
+func (w *WebHandler) serveConnect(resp http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		return
+	}
+	method := w.methods[r.URL.Path]
+	contentType := connectContentType(r)
+	streaming := contentType == connectStreamJSON || contentType == connectStreamProto
+	useJSON := contentType == connectUnaryJSON || contentType == connectStreamJSON
+	if streaming != method.serverStreams {
+		writeConnectError(resp, codes.Unimplemented, fmt.Sprintf("content type %v does not match the method", contentType), nil)
+		return
+	}
+
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		writeConnectError(resp, codes.Unimplemented, fmt.Sprintf("content encoding %v is not supported", encoding), nil)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxConnectRequestSize+frameHeaderSize+1))
+	if err != nil {
+		writeConnectError(resp, codes.Internal, err.Error(), nil)
+		return
+	}
+	if streaming {
+		if len(body) < frameHeaderSize || int(binary.BigEndian.Uint32(body[1:frameHeaderSize])) != len(body)-frameHeaderSize {
+			writeConnectError(resp, codes.InvalidArgument, "request must be a single enveloped message", nil)
+			return
+		}
+		body = body[frameHeaderSize:]
+	}
+	if len(body) > maxConnectRequestSize {
+		writeConnectError(resp, codes.ResourceExhausted, "request message too large", nil)
+		return
+	}
+	request, err := convertMessage(method.descriptor.Input(), body, useJSON, false)
+	if err != nil {
+		writeConnectError(resp, codes.InvalidArgument, err.Error(), nil)
+		return
+	}
+
+	webRequest := r.Clone(r.Context())
+	webRequest.Body = io.NopCloser(bytes.NewReader(frame(0, request)))
+	webRequest.ContentLength = int64(frameHeaderSize + len(request))
+	webRequest.Header.Set("Content-Type", grpcWebContentType)
+	if timeout := r.Header.Get(connectTimeoutHeader); timeout != "" {
+		if _, err := strconv.ParseUint(timeout, 10, 64); err == nil {
+			webRequest.Header.Set("Grpc-Timeout", timeout+"m")
+		}
+	}
+
+	translator := &connectResponse{
+		resp:        resp,
+		method:      method,
+		streaming:   streaming,
+		useJSON:     useJSON,
+		contentType: contentType,
+		header:      make(http.Header),
+	}
+	w.serveGRPCWeb(translator, webRequest)
+	translator.finish()
+}
+
+// connectResponse is the gRPC-Web response writer, converting the frames into the Connect response as they are written
+type connectResponse struct {
+	resp        http.ResponseWriter
+	method      *webMethod
+	streaming   bool
+	useJSON     bool
+	contentType string
+
+	header      http.Header
+	buffer      []byte
+	messages    [][]byte
+	trailers    http.Header
+	wroteHeader bool
+	failed      bool
+}
+
+func (c *connectResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *connectResponse) WriteHeader(int) {}
+
+func (c *connectResponse) Write(b []byte) (int, error) {
+	c.buffer = append(c.buffer, b...)
+	for len(c.buffer) >= frameHeaderSize {
+		length := int(binary.BigEndian.Uint32(c.buffer[1:frameHeaderSize]))
+		if len(c.buffer) < frameHeaderSize+length {
+			break
+		}
+		flags, payload := c.buffer[0], c.buffer[frameHeaderSize:frameHeaderSize+length]
+		if flags&frameTrailers != 0 {
+			c.trailers = parseTrailers(payload)
+		} else if err := c.message(payload); err != nil {
+			return 0, err
+		}
+		c.buffer = c.buffer[frameHeaderSize+length:]
+	}
+	return len(b), nil
+}
+
+func (c *connectResponse) Flush() {
+	if c.streaming && c.wroteHeader {
+		if flusher, ok := c.resp.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// message sends a streamed message right away, unary messages wait for the status
+func (c *connectResponse) message(payload []byte) error {
+	message, err := convertMessage(c.method.descriptor.Output(), payload, c.useJSON, true)
+	if err != nil {
+		c.failed = true
+		return err
+	}
+	if !c.streaming {
+		c.messages = append(c.messages, message)
+		return nil
+	}
+	c.writeHeader(http.StatusOK)
+	_, err = c.resp.Write(frame(0, message))
+	return err
+}
+
+func (c *connectResponse) writeHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	for key, values := range c.header {
+		if isConnectMetadata(key) {
+			c.resp.Header()[key] = values
+		}
+	}
+	c.resp.Header().Set("Content-Type", c.contentType)
+	c.resp.WriteHeader(status)
+}
+
+// finish writes the status, found in the trailers or, without any messages, in the headers
+func (c *connectResponse) finish() {
+	code, message := codes.Internal, "missing status"
+	for _, source := range []http.Header{c.trailers, c.header} {
+		if value := source.Get("Grpc-Status"); value != "" {
+			if parsed, err := strconv.ParseUint(value, 10, 32); err == nil {
+				code, message = codes.Code(parsed), source.Get("Grpc-Message")
+			}
+			break
+		}
+	}
+	if c.failed {
+		code, message = codes.Internal, "could not convert response message"
+	}
+
+	if !c.streaming {
+		if code != codes.OK {
+			writeConnectError(c.resp, code, message, c.header)
+			return
+		}
+		if len(c.messages) != 1 {
+			writeConnectError(c.resp, codes.Internal, "unary method did not return a single message", c.header)
+			return
+		}
+		c.writeHeader(http.StatusOK)
+		_, _ = c.resp.Write(c.messages[0])
+		return
+	}
+
+	endStream := map[string]interface{}{}
+	if code != codes.OK {
+		endStream["error"] = connectError(code, message)
+	}
+	if metadata := connectMetadata(c.trailers); len(metadata) > 0 {
+		endStream["metadata"] = metadata
+	}
+	content, _ := json.Marshal(endStream)
+	c.writeHeader(http.StatusOK)
+	_, _ = c.resp.Write(frame(frameEndStream, content))
+	c.Flush()
+}
+
+func writeConnectError(resp http.ResponseWriter, code codes.Code, message string, header http.Header) {
+	for key, values := range header {
+		if isConnectMetadata(key) {
+			resp.Header()[key] = values
+		}
+	}
+	httpStatus := http.StatusInternalServerError
+	if connectCode, ok := connectCodes[code]; ok {
+		httpStatus = connectCode.httpStatus
+	}
+	resp.Header().Set("Content-Type", connectUnaryJSON)
+	resp.WriteHeader(httpStatus)
+	_ = json.NewEncoder(resp).Encode(connectError(code, message))
+}
+
+func connectError(code codes.Code, message string) map[string]string {
+	name := "unknown"
+	if connectCode, ok := connectCodes[code]; ok {
+		name = connectCode.name
+	}
+	connectErr := map[string]string{"code": name}
+	if message != "" {
+		connectErr["message"] = message
+	}
+	return connectErr
+}
+
+// convertMessage converts between the Connect encoding and the binary encoding GRPC uses
+func convertMessage(descriptor protoreflect.MessageDescriptor, content []byte, useJSON bool, toConnect bool) ([]byte, error) {
+	if !useJSON {
+		return content, nil
+	}
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(descriptor.FullName())
+	if err != nil {
+		return nil, err
+	}
+	message := messageType.New().Interface()
+	if toConnect {
+		if err := proto.Unmarshal(content, message); err != nil {
+			return nil, err
+		}
+		return protojson.Marshal(message)
+	}
+	if len(bytes.TrimSpace(content)) > 0 {
+		if err := protojson.Unmarshal(content, message); err != nil {
+			return nil, err
+		}
+	}
+	return proto.Marshal(message)
+}
+
+func frame(flags byte, payload []byte) []byte {
+	framed := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	framed[0] = flags
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(payload)))
+	return append(framed, payload...)
+}
+
+func parseTrailers(payload []byte) http.Header {
+	trailers := make(http.Header)
+	for _, line := range strings.Split(string(payload), "\r\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found {
+			trailers.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+	return trailers
+}
+
+// isConnectMetadata filters out the GRPC protocol headers
+func isConnectMetadata(key string) bool {
+	lowerKey := strings.ToLower(key)
+	return !strings.HasPrefix(lowerKey, "grpc-") && lowerKey != "content-type" && lowerKey != "content-length" &&
+		!strings.HasPrefix(lowerKey, "access-control-") && lowerKey != "trailer"
+}
+
+func connectMetadata(trailers http.Header) map[string][]string {
+	metadata := make(map[string][]string)
+	for key, values := range trailers {
+		if isConnectMetadata(key) {
+			metadata[strings.ToLower(key)] = values
+		}
+	}
+	return metadata
+}
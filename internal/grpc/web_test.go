@@ -0,0 +1,296 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/joostvdg/gitstafette/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testOrigin      = "https://app.example.com"
+	statusMethod    = "/gitstafette.v1.Gitstafette/WebhookEventStatus"
+	statusesMethod  = "/gitstafette.v1.Gitstafette/WebhookEventStatuses"
+	missingRepoText = "repository id is required"
+)
+
+// testService answers the status calls, failing them for an empty repository or the client "fail"
+type testService struct {
+	api.UnimplementedGitstafetteServer
+}
+
+func (testService) WebhookEventStatus(_ context.Context, request *api.WebhookEventStatusRequest) (*api.WebhookEventStatusResponse, error) {
+	if request.RepositoryId == "" {
+		return nil, status.Error(codes.InvalidArgument, missingRepoText)
+	}
+	return &api.WebhookEventStatusResponse{ServerId: "test", RepositoryId: request.RepositoryId, Status: "OK"}, nil
+}
+
+func (testService) WebhookEventStatuses(request *api.WebhookEventStatusesRequest, srv api.Gitstafette_WebhookEventStatusesServer) error {
+	for _, repositoryId := range []string{"1", "2"} {
+		if err := srv.Send(&api.WebhookEventStatusResponse{ServerId: "test", RepositoryId: repositoryId, Status: "OK"}); err != nil {
+			return err
+		}
+	}
+	if request.ClientId == "fail" {
+		return status.Error(codes.PermissionDenied, "client may not fetch")
+	}
+	return nil
+}
+
+func newTestWebServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	grpcServer := grpc.NewServer()
+	api.RegisterGitstafetteServer(grpcServer, testService{})
+	server := httptest.NewServer(NewWebHandler(grpcServer, []string{testOrigin}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func post(t *testing.T, url string, contentType string, body []byte) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", contentType)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func marshal(t *testing.T, message proto.Message) []byte {
+	t.Helper()
+	content, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// readFrames splits a response body into its messages and its trailer or end of stream frame
+func readFrames(t *testing.T, body io.Reader) ([][]byte, []byte) {
+	t.Helper()
+	content, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages [][]byte
+	var last []byte
+	for len(content) > 0 {
+		if len(content) < frameHeaderSize {
+			t.Fatalf("incomplete frame header %q", content)
+		}
+		length := int(binary.BigEndian.Uint32(content[1:frameHeaderSize]))
+		if len(content) < frameHeaderSize+length {
+			t.Fatalf("incomplete frame of %d bytes", length)
+		}
+		payload := content[frameHeaderSize : frameHeaderSize+length]
+		if content[0]&(frameTrailers|frameEndStream) != 0 {
+			last = payload
+		} else {
+			messages = append(messages, payload)
+		}
+		content = content[frameHeaderSize+length:]
+	}
+	return messages, last
+}
+
+func repositoryIds(t *testing.T, messages [][]byte, unmarshal func([]byte, proto.Message) error) []string {
+	t.Helper()
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		response := new(api.WebhookEventStatusResponse)
+		if err := unmarshal(message, response); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, response.RepositoryId)
+	}
+	return ids
+}
+
+func TestGRPCWeb(t *testing.T) {
+	server := newTestWebServer(t)
+	tests := []struct {
+		name    string
+		method  string
+		request proto.Message
+		ids     []string
+		status  string
+		message string
+	}{
+		{name: "unary", method: statusMethod, request: &api.WebhookEventStatusRequest{RepositoryId: "1"}, ids: []string{"1"}, status: "0"},
+		{name: "unary error", method: statusMethod, request: &api.WebhookEventStatusRequest{}, ids: []string{}, status: "3", message: missingRepoText},
+		{name: "server streaming", method: statusesMethod, request: &api.WebhookEventStatusesRequest{}, ids: []string{"1", "2"}, status: "0"},
+		{name: "server streaming error", method: statusesMethod, request: &api.WebhookEventStatusesRequest{ClientId: "fail"}, ids: []string{"1", "2"}, status: "7", message: "client may not fetch"},
+	}
+	for _, text := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name + " binary"
+			if text {
+				name = tt.name + " text"
+			}
+			t.Run(name, func(t *testing.T) {
+				request := frame(0, marshal(t, tt.request))
+				contentType := grpcWebContentType
+				if text {
+					// every part encoded on its own, with its own padding
+					request = []byte(base64.StdEncoding.EncodeToString(request[:frameHeaderSize]) +
+						base64.StdEncoding.EncodeToString(request[frameHeaderSize:]))
+					contentType = grpcWebTextContentType
+				}
+				response := post(t, server.URL+tt.method, contentType, request)
+				if response.StatusCode != http.StatusOK {
+					t.Fatalf("status = %v, want 200", response.Status)
+				}
+				if got := response.Header.Get("Content-Type"); got != contentType {
+					t.Errorf("content type = %v, want %v", got, contentType)
+				}
+				var body io.Reader = response.Body
+				if text {
+					body = &textReader{reader: bufio.NewReader(response.Body)}
+				}
+				messages, trailerFrame := readFrames(t, body)
+				if ids := repositoryIds(t, messages, proto.Unmarshal); strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+					t.Errorf("messages for repositories %v, want %v", ids, tt.ids)
+				}
+				trailers := parseTrailers(trailerFrame)
+				if got := trailers.Get("Grpc-Status"); got != tt.status {
+					t.Errorf("grpc-status = %q, want %q (trailers %q)", got, tt.status, trailerFrame)
+				}
+				if got := trailers.Get("Grpc-Message"); got != tt.message {
+					t.Errorf("grpc-message = %q, want %q", got, tt.message)
+				}
+			})
+		}
+	}
+}
+
+func TestConnectUnary(t *testing.T) {
+	server := newTestWebServer(t)
+	request := &api.WebhookEventStatusRequest{RepositoryId: "1"}
+
+	t.Run("json", func(t *testing.T) {
+		response := post(t, server.URL+statusMethod, connectUnaryJSON, []byte(`{"repositoryId":"1"}`))
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("status = %v, want 200", response.Status)
+		}
+		content, _ := io.ReadAll(response.Body)
+		if ids := repositoryIds(t, [][]byte{content}, protojson.Unmarshal); ids[0] != "1" {
+			t.Errorf("response for repository %v, want 1", ids[0])
+		}
+	})
+
+	t.Run("proto", func(t *testing.T) {
+		response := post(t, server.URL+statusMethod, connectUnaryProto, marshal(t, request))
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("status = %v, want 200", response.Status)
+		}
+		if got := response.Header.Get("Content-Type"); got != connectUnaryProto {
+			t.Errorf("content type = %v, want %v", got, connectUnaryProto)
+		}
+		content, _ := io.ReadAll(response.Body)
+		if ids := repositoryIds(t, [][]byte{content}, proto.Unmarshal); ids[0] != "1" {
+			t.Errorf("response for repository %v, want 1", ids[0])
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		response := post(t, server.URL+statusMethod, connectUnaryJSON, []byte(`{}`))
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status = %v, want 400", response.Status)
+		}
+		var connectErr map[string]string
+		if err := json.NewDecoder(response.Body).Decode(&connectErr); err != nil {
+			t.Fatal(err)
+		}
+		if connectErr["code"] != "invalid_argument" || connectErr["message"] != missingRepoText {
+			t.Errorf("error = %v, want invalid_argument: %v", connectErr, missingRepoText)
+		}
+	})
+}
+
+func TestConnectServerStreaming(t *testing.T) {
+	server := newTestWebServer(t)
+	tests := []struct {
+		name        string
+		contentType string
+		request     []byte
+		unmarshal   func([]byte, proto.Message) error
+		error       string
+	}{
+		{name: "json", contentType: connectStreamJSON, request: []byte(`{}`), unmarshal: protojson.Unmarshal},
+		{name: "proto", contentType: connectStreamProto, request: marshal(t, &api.WebhookEventStatusesRequest{}), unmarshal: proto.Unmarshal},
+		{name: "error", contentType: connectStreamJSON, request: []byte(`{"clientId":"fail"}`), unmarshal: protojson.Unmarshal, error: "permission_denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := post(t, server.URL+statusesMethod, tt.contentType, frame(0, tt.request))
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %v, want 200", response.Status)
+			}
+			messages, endStream := readFrames(t, response.Body)
+			if ids := repositoryIds(t, messages, tt.unmarshal); strings.Join(ids, ",") != "1,2" {
+				t.Errorf("messages for repositories %v, want [1 2]", ids)
+			}
+			var end struct {
+				Error map[string]string `json:"error"`
+			}
+			if err := json.Unmarshal(endStream, &end); err != nil {
+				t.Fatalf("end of stream %q: %v", endStream, err)
+			}
+			if end.Error["code"] != tt.error {
+				t.Errorf("end of stream error = %v, want %q", end.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestWebOrigins(t *testing.T) {
+	server := newTestWebServer(t)
+
+	request, _ := http.NewRequest(http.MethodPost, server.URL+statusMethod, strings.NewReader(`{"repositoryId":"1"}`))
+	request.Header.Set("Content-Type", connectUnaryJSON)
+	request.Header.Set("Origin", "https://evil.example.com")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("status for another origin = %v, want 403", response.Status)
+	}
+
+	preflight, _ := http.NewRequest(http.MethodOptions, server.URL+statusMethod, nil)
+	preflight.Header.Set("Origin", testOrigin)
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	preflight.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+	response, err = http.DefaultClient.Do(preflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if got := response.Header.Get("Access-Control-Allow-Origin"); got != testOrigin {
+		t.Errorf("allowed origin = %q, want %q", got, testOrigin)
+	}
+	if got := response.Header.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("allowed credentials = %q, want none", got)
+	}
+}
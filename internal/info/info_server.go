@@ -4,6 +4,7 @@ import (
 	"context"
 	infoapi "github.com/joostvdg/gitstafette/api/info"
 	api "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/cache"
 	"github.com/joostvdg/gitstafette/internal/otel_util"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel/trace"
@@ -48,7 +49,15 @@ func (srv *InfoServer) GetInfo(ctx context.Context, req *infoapi.GetInfoRequest)
 		hostname = os.Getenv("HOSTNAME")
 	}
 
-	repos := strings.Join(srv.ServerConfig.Repositories, ",")
+	repositories := srv.ServerConfig.Repositories
+	if cache.Repositories != nil {
+		repositories = cache.Repositories.WatchedRepositories()
+	}
+	descriptions := make([]string, 0, len(repositories))
+	for _, repository := range repositories {
+		descriptions = append(descriptions, cache.DescribeRepository(repository))
+	}
+	repos := strings.Join(descriptions, ",")
 	server := &infoapi.ServerInfo{
 		Hostname:     hostname,
 		Port:         srv.ServerConfig.Port,
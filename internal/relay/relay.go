@@ -19,11 +19,16 @@ import (
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
+	"maps"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 )
 
+// drainRetryInterval is how long a drain waits before retrying the events it could not relay
+const drainRetryInterval = time.Second
+
 // TODO periodically relay message to relay endpoint
 // TODO health check on relay endpoint
 // TODO remove relayed messages from cache
@@ -41,39 +46,40 @@ func init() {
 	sublogger = log.With().Str("component", "relay").Logger()
 }
 
-func InitiateRelay(serviceContext *gcontext.ServiceContext, repositoryId string) {
+// InitiateRelay relays the cached events of the repositories until the context is done, the returned wait group
+// is done once every relay stopped, after finishing the events it was relaying
+func InitiateRelay(serviceContext *gcontext.ServiceContext, repositoryIds []string) *sync.WaitGroup {
+	relays := new(sync.WaitGroup)
 	relayConfig := serviceContext.Relay
 	if relayConfig.Enabled {
 		go RelayHealthCheck(serviceContext)
-		go RelayCachedEvents(serviceContext, repositoryId)
+		for _, repositoryId := range repositoryIds {
+			relays.Add(1)
+			go func() {
+				defer relays.Done()
+				RelayCachedEvents(serviceContext, repositoryId)
+			}()
+		}
 	} else {
 		sublogger.Info().Msg("Relay is disabled")
 	}
+	return relays
 }
 
-// TODO API should have a function To/From internal/external rep
 func eventHeadersToHTTPHeaders(eventHeaders []v1.WebhookEventHeader) http.Header {
-	var headers http.Header = make(map[string][]string)
-
-	for _, header := range eventHeaders {
-		key := header.Key
-		value := header.FirstValue
-		values := make([]string, 1)
-		values[0] = value
-		headers[key] = values
-	}
-	return headers
+	return v1.EventHeadersToHTTPHeaders(eventHeaders)
 }
 
-// HTTPRelay testing the relay functionality
-func HTTPRelay(event *v1.WebhookEventInternal, relayEndpoint *url.URL) {
+// HTTPRelay posts the event to the endpoint, an error tells the event did not arrive. The post is abandoned once the
+// context is done.
+func HTTPRelay(ctx context.Context, event *v1.WebhookEventInternal, relayEndpoint *url.URL) error {
 	client := resty.New()
 	// TODO: handle this based on secure/insecure and TLS config
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 	}
 	client.SetTLSClientConfig(tlsConfig)
-	request := client.R().SetBody(event.EventBody)
+	request := client.R().SetContext(ctx).SetBody(event.EventBody)
 	request.Header = eventHeadersToHTTPHeaders(event.Headers)
 	response, err := request.Post(relayEndpoint.String())
 	if err != nil {
@@ -81,11 +87,14 @@ func HTTPRelay(event *v1.WebhookEventInternal, relayEndpoint *url.URL) {
 			event.ID, relayEndpoint, err)
 		sublogger.Warn().Msgf("Request: %v\n", request)
 		sublogger.Warn().Msgf("Request Headers: %v\n", request.Header)
-	} else {
-		sublogger.Info().Msgf("[relay] Valid Relay Response (%v) - {event: %v, endpoint: %v}: %v\n", response.StatusCode(),
-			event.ID, relayEndpoint, response)
+		return err
 	}
-
+	if response.IsError() {
+		return fmt.Errorf("relay endpoint %v responded with %v", relayEndpoint, response.Status())
+	}
+	sublogger.Info().Msgf("[relay] Valid Relay Response (%v) - {event: %v, endpoint: %v}: %v\n", response.StatusCode(),
+		event.ID, relayEndpoint, response)
+	return nil
 }
 
 func RelayCachedEvents(serviceContext *gcontext.ServiceContext, repositoryId string) {
@@ -104,32 +113,83 @@ func RelayCachedEvents(serviceContext *gcontext.ServiceContext, repositoryId str
 		sublogger.Warn().Err(err).Msg("Encountered an error when creating histogram")
 	}
 
+	// events are relayed as soon as they are cached, the clock catches those whose relay failed
+	subscription := cache.Notifier.Subscribe([]string{repositoryId})
+	defer subscription.Close()
 	for {
+		// the first pass relays what was cached before we started, such as the events in an outbox
+		relayPendingEvents(ctx, relay, repositoryId, histogram)
+
 		select {
 		case <-clock.C:
-			// TODO handle properly
-			events := cache.Store.RetrieveEventsForRepository(repositoryId)
-			for _, webhookEvent := range events {
-				if !webhookEvent.IsRelayed {
-					if relay.Protocol == "grpc" {
-						GRPCRelay(webhookEvent, relay, repositoryId)
-					} else {
-						HTTPRelay(webhookEvent, relay.Endpoint)
-					}
+		case <-subscription.C:
+		case <-ctx.Done(): // Activated when ctx.Done() closes
+			sublogger.Info().Msg("Closing RelayCachedEvents")
+			return
+		}
+	}
+}
 
-					// TODO add check on relay, so that we only set IsRelayed if we actually did
-					webhookEvent.IsRelayed = true
+// relayPendingEvents relays the events of the repository not relayed yet, where a pattern relays the events of every
+// repository it matches, and returns per repository how many could not be relayed. Once the context is done the
+// remaining events are no longer tried.
+func relayPendingEvents(ctx context.Context, relay *v1.RelayConfig, repositoryId string, histogram otelapi.Int64Histogram) map[string]int {
+	remaining := make(map[string]int)
+	for _, matchingRepositoryId := range cache.MatchingRepositories(repositoryId) {
+		events := cache.Store.RetrieveEventsForRepository(matchingRepositoryId)
+		for _, webhookEvent := range events {
+			if !webhookEvent.IsRelayed {
+				if ctx.Err() != nil {
+					remaining[matchingRepositoryId]++
+					continue
+				}
+				var err error
+				if relay.Protocol == "grpc" {
+					err = GRPCRelay(ctx, webhookEvent, relay, matchingRepositoryId)
+				} else {
+					err = HTTPRelay(ctx, webhookEvent, relay.EndpointFor(cache.RepositoryAliases(matchingRepositoryId)...))
+				}
+				if err != nil {
+					// not marked as relayed, so it is tried again on the next pass
+					sublogger.Warn().Err(err).Str("repo", matchingRepositoryId).Msgf("Could not relay event %v", webhookEvent.ID)
+					remaining[matchingRepositoryId]++
+					continue
+				}
+
+				cache.Store.MarkRelayed(matchingRepositoryId, webhookEvent.ID)
+				if histogram != nil {
 					histogram.Record(ctx, 1)
 				}
 			}
-		case <-ctx.Done(): // Activated when ctx.Done() closes
-			sublogger.Info().Msg("Closing RelayCachedEvents")
-			return
+		}
+	}
+	return remaining
+}
+
+// DrainCachedEvents relays the events not relayed yet, retrying those that fail until the context is done,
+// and returns per repository how many remain
+func DrainCachedEvents(ctx context.Context, relay *v1.RelayConfig, repositoryIds []string) map[string]int {
+	retry := time.NewTicker(drainRetryInterval)
+	defer retry.Stop()
+	for {
+		remaining := make(map[string]int)
+		for _, repositoryId := range repositoryIds {
+			maps.Copy(remaining, relayPendingEvents(ctx, relay, repositoryId, nil))
+		}
+		if len(remaining) == 0 {
+			return remaining
+		}
+		select {
+		case <-retry.C:
+		case <-ctx.Done():
+			return remaining
 		}
 	}
 }
 
-func GRPCRelay(internalEvent *v1.WebhookEventInternal, relay *v1.RelayConfig, repositoryId string) {
+// GRPCRelay pushes the event to the relay server, an error tells it did not accept the event. The push is abandoned
+// once the context is done.
+func GRPCRelay(ctx context.Context, internalEvent *v1.WebhookEventInternal, relay *v1.RelayConfig, repositoryId string) error {
 	systemRoots, err := x509.SystemCertPool()
 	if err != nil {
 		sublogger.Warn().Err(err).Msg("cannot load root CA certs")
@@ -150,6 +210,7 @@ func GRPCRelay(internalEvent *v1.WebhookEventInternal, relay *v1.RelayConfig, re
 	if err != nil {
 		sublogger.Fatal().Err(err).Str("server", server).Msg("cannot connect to the config")
 	}
+	defer conn.Close()
 
 	client := v1.NewGitstafetteClient(conn)
 	event := v1.InternalToExternalEvent(internalEvent)
@@ -159,12 +220,15 @@ func GRPCRelay(internalEvent *v1.WebhookEventInternal, relay *v1.RelayConfig, re
 		WebhookEvent: event,
 	}
 
-	ctx := context.Background()
 	response, err := client.WebhookEventPush(ctx, request)
 	if err != nil {
-		sublogger.Fatal().Err(err).Msg("could not open stream")
+		return fmt.Errorf("could not push event to %v: %w", server, err)
 	}
 	sublogger.Info().Msgf("GRPC Push response: %v\n", response)
+	if !response.Accepted {
+		return fmt.Errorf("relay server %v did not accept the event: %v", server, response.ResponseDescription)
+	}
+	return nil
 }
 
 /**
@@ -193,8 +257,12 @@ func RelayHealthCheck(serviceContext *gcontext.ServiceContext) {
 		select {
 		case <-clock.C:
 			// TODO do healthcheck
-			repoIds := cache.Repositories.Repositories
-			log.Printf("[relay] We have %v repositories (%v)", len(repoIds), repoIds)
+			repoIds := cache.Repositories.WatchedRepositories()
+			descriptions := make([]string, 0, len(repoIds))
+			for _, repoId := range repoIds {
+				descriptions = append(descriptions, cache.DescribeRepository(repoId))
+			}
+			log.Printf("[relay] We have %v repositories (%v)", len(repoIds), descriptions)
 			status.TimeOfLastCheck = time.Now()
 			healthy := false
 			var err error
@@ -326,7 +394,7 @@ func CleanupRelayedEvents(serviceContext *gcontext.ServiceContext) {
 	for {
 		select {
 		case <-clock.C:
-			repoIds := cache.Repositories.Repositories
+			repoIds := cache.WatchedRepositoryIDs()
 			for _, repositoryId := range repoIds {
 				cachedEvents := cache.Store.RetrieveEventsForRepository(repositoryId)
 				for _, cachedEvent := range cachedEvents {
@@ -2,8 +2,11 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/joostvdg/gitstafette/internal/auth"
 	"github.com/joostvdg/gitstafette/internal/cache"
+	"github.com/joostvdg/gitstafette/internal/e2e"
 	"github.com/joostvdg/gitstafette/internal/otel_util"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -11,10 +14,15 @@ import (
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	//semconv "go.opentelemetry.io/otel_util/semconv/v1.18.0"
 	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/rs/zerolog/log"
+	"maps"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -23,9 +31,16 @@ import (
 
 type GitstafetteServer struct {
 	api.UnimplementedGitstafetteServer
-	Tracer           trace.Tracer
-	MeterProvider    *sdkmetric.MeterProvider
+	Tracer        trace.Tracer
+	MeterProvider *sdkmetric.MeterProvider
+	// ResponseInterval is how long a stream waits without events before sending an empty response as heartbeat
 	ResponseInterval time.Duration
+	// MaxStreamAge is how long a stream lives before the client is asked to reconnect, zero lets it live indefinitely
+	MaxStreamAge time.Duration
+	// RepositoryRegistration allows clients to register the repositories they serve
+	RepositoryRegistration bool
+	// Authorizer checks every repository a requested pattern matches, as access is granted per repository
+	Authorizer *auth.Authorizer
 }
 
 func (s GitstafetteServer) WebhookEventStatus(ctx context.Context, req *api.WebhookEventStatusRequest) (*api.WebhookEventStatusResponse, error) {
@@ -114,16 +129,101 @@ func (s GitstafetteServer) WebhookEventPush(ignoredContext context.Context, requ
 		Accepted:            false,
 	}
 
-	err := cache.Event(request.RepositoryId, request.WebhookEvent)
+	repositoryId := cache.ResolveRepositoryID(request.RepositoryId)
+	err := cache.Event(repositoryId, request.WebhookEvent)
 	if err == nil {
 		response.Accepted = true
-		log.Printf("Accepted Webhook Event Push for Repo %v: %v", request.RepositoryId, request.WebhookEvent.EventId)
+		log.Printf("Accepted Webhook Event Push for Repo %v: %v", cache.DescribeRepository(repositoryId), request.WebhookEvent.EventId)
 	}
 	return response, err
 }
 
+func (s GitstafetteServer) RegisterClientKey(ctx context.Context, request *api.RegisterClientKeyRequest) (*api.RegisterClientKeyResponse, error) {
+	// the key decides who can read the events of the repository, so we must know who registers it
+	identity, ok := auth.IdentityFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(grpccodes.FailedPrecondition, "this server does not authenticate clients, so it does not accept end-to-end encryption keys")
+	}
+	// the key belongs to the client that authenticated, not to whoever the request names
+	if identity.ClientID == "" {
+		return nil, status.Errorf(grpccodes.PermissionDenied, "%v does not identify a single client, so it cannot register an end-to-end encryption key", identity)
+	}
+	if request.ClientId != "" && request.ClientId != identity.ClientID {
+		return nil, status.Errorf(grpccodes.PermissionDenied, "%v may not register a key for client %v", identity, request.ClientId)
+	}
+	repositoryId := cache.ResolveRepositoryID(request.RepositoryId)
+	if cache.IsRepositoryPattern(repositoryId) {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "end-to-end encryption keys are registered per repository, not for pattern %v", repositoryId)
+	}
+	if !cache.Repositories.RepositoryIsWatched(repositoryId) {
+		return nil, status.Errorf(grpccodes.NotFound, "repository %v is not watched", request.RepositoryId)
+	}
+	if _, err := e2e.ParsePublicKey(request.PublicKey); err != nil {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "invalid public key: %v", err)
+	}
+
+	clientKey := &cache.ClientKey{
+		ClientID:       identity.ClientID,
+		RepositoryID:   repositoryId,
+		KeyID:          e2e.KeyID(request.PublicKey),
+		PublicKey:      request.PublicKey,
+		TimeRegistered: time.Now(),
+	}
+	if err := cache.ClientKeys.Register(clientKey); err != nil {
+		if errors.Is(err, cache.ErrClientKeyHeld) {
+			return nil, status.Errorf(grpccodes.PermissionDenied, "could not register key for repository %v: %v", request.RepositoryId, err)
+		}
+		log.Printf("Could not register key of client %v for repository %v: %v", identity.ClientID, request.RepositoryId, err)
+		return nil, status.Errorf(grpccodes.Internal, "could not register key for repository %v", request.RepositoryId)
+	}
+	log.Printf("Registered end-to-end encryption key %v of client %v for repository %v", clientKey.KeyID, identity.ClientID, cache.DescribeRepository(repositoryId))
+	return &api.RegisterClientKeyResponse{
+		Accepted:            true,
+		KeyId:               clientKey.KeyID,
+		ResponseDescription: "event bodies for the repository are encrypted with this key",
+	}, nil
+}
+
+func (s GitstafetteServer) RegisterRepository(ctx context.Context, request *api.RegisterRepositoryRequest) (*api.RegisterRepositoryResponse, error) {
+	if !s.RepositoryRegistration {
+		return nil, status.Errorf(grpccodes.FailedPrecondition, "this server does not accept repository registrations")
+	}
+	if request.RepositoryId == "" {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "cannot register an empty repository id")
+	}
+	repositoryId := cache.ResolveRepositoryID(request.RepositoryId)
+	if !cache.RegisterRepository(repositoryId) {
+		return nil, status.Errorf(grpccodes.Internal, "could not register repository %v", request.RepositoryId)
+	}
+	log.Printf("Client %v registered repository %v", request.ClientId, cache.DescribeRepository(repositoryId))
+	return &api.RegisterRepositoryResponse{
+		Accepted:            true,
+		ResponseDescription: "events for the repository are cached while clients keep connecting",
+	}, nil
+}
+
+func (s GitstafetteServer) AcknowledgeWebhookEvents(ctx context.Context, request *api.AcknowledgeWebhookEventsRequest) (*api.AcknowledgeWebhookEventsResponse, error) {
+	repositoryId := cache.ResolveRepositoryID(request.RepositoryId)
+	if cache.IsRepositoryPattern(repositoryId) {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "events are acknowledged per repository, not for pattern %v", repositoryId)
+	}
+	if !cache.Repositories.RepositoryIsWatched(repositoryId) {
+		return nil, status.Errorf(grpccodes.NotFound, "repository %v is not watched", request.RepositoryId)
+	}
+	acknowledged := uint32(0)
+	for _, eventId := range request.EventIds {
+		if cache.Store.MarkRelayed(repositoryId, eventId) {
+			acknowledged++
+		}
+	}
+	log.Printf("Client %v acknowledged %d events for repository %v", request.ClientId, acknowledged, cache.DescribeRepository(repositoryId))
+	return &api.AcknowledgeWebhookEventsResponse{Acknowledged: acknowledged}, nil
+}
+
 func (s GitstafetteServer) FetchWebhookEvents(request *api.WebhookEventsRequest, srv api.Gitstafette_FetchWebhookEventsServer) error {
-	log.Printf("Relaying webhook events for repository %s", request.RepositoryId)
+	repositoryIds := subscribedRepositories(request)
+	repositories := describeRepositories(repositoryIds)
+	log.Printf("Relaying webhook events for repository %s", repositories)
 	tracer := s.Tracer
 	var counter otelmetric.Int64Counter
 	otelEnabled := otel_util.IsOTelEnabled()
@@ -135,10 +235,23 @@ func (s GitstafetteServer) FetchWebhookEvents(request *api.WebhookEventsRequest,
 		)
 	}
 
-	durationSeconds := request.GetDurationSecs()
-	finish := time.Now().Add(time.Second * time.Duration(durationSeconds))
-	log.Printf("Stream is alive from %v to %v", time.Now(), finish)
-	log.Printf("Response Interval is: %v", s.ResponseInterval)
+	// without a duration the stream lives until the client goes away, or the server asks it to reconnect
+	var deadline <-chan time.Time
+	if durationSeconds := request.GetDurationSecs(); durationSeconds > 0 {
+		finish := time.NewTimer(time.Second * time.Duration(durationSeconds))
+		defer finish.Stop()
+		deadline = finish.C
+		log.Printf("Stream is alive from %v to %v", time.Now(), time.Now().Add(time.Second*time.Duration(durationSeconds)))
+	} else {
+		log.Printf("Stream is alive from %v until closed", time.Now())
+	}
+	var rebalance <-chan time.Time
+	if s.MaxStreamAge > 0 {
+		maxAge := time.NewTimer(s.MaxStreamAge)
+		defer maxAge.Stop()
+		rebalance = maxAge.C
+	}
+	log.Printf("Heartbeat interval is: %v", s.ResponseInterval)
 
 	ctx, stop := signal.NotifyContext(srv.Context(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -159,87 +272,222 @@ func (s GitstafetteServer) FetchWebhookEvents(request *api.WebhookEventsRequest,
 			Logger()
 	}
 
+	cursors := make(map[string]uint64)
+	if len(repositoryIds) == 1 && !cache.IsRepositoryPattern(repositoryIds[0]) {
+		cursors[repositoryIds[0]] = request.GetLastReceivedEventId()
+	}
+	for repositoryId, cursor := range request.GetCursors() {
+		cursors[cache.ResolveRepositoryID(repositoryId)] = cursor
+	}
+	touchRegistrations(repositoryIds)
+	// the interceptor authorized a requested pattern, not every repository it matches
+	identity, _ := auth.IdentityFromContext(srv.Context())
+	mayFetch := func(repositoryId string) bool {
+		return s.Authorizer.Authorize(identity, auth.PermissionFetch, request.ClientId, repositoryId) == nil
+	}
+
+	// events are sent as soon as they are stored, and a heartbeat is sent when there were none for a while
+	subscription := cache.Notifier.Subscribe(repositoryIds)
+	defer subscription.Close()
+	heartbeat := time.NewTimer(0)
+	defer heartbeat.Stop()
+	reason := "timeout"
+	sent := false
 timed:
-	for time.Now().Before(finish) {
+	for {
+		heartbeatDue := false
 		select {
-		case <-time.After(s.ResponseInterval):
-			var childSpan trace.Span
-			if otelEnabled {
-				_, childSpan = tracer.Start(parentSpanContext, "retrieveCachedEventsForRepository", trace.WithSpanKind(trace.SpanKindServer))
-			}
-
-			sublogger.Info().Msgf("Fetching events for repo %v (with Span)", request.RepositoryId)
+		case <-subscription.C:
+		case <-heartbeat.C:
+			heartbeatDue = true
+		case <-deadline:
+			break timed
+		case <-rebalance:
+			// clients reconnect through the load balancer, spreading them over the servers, including new ones
+			sublogger.Info().Msgf("Closing FetchWebhookEvents (stream of client %s reached its maximum age)", request.ClientId)
+			sendDrainingNotice(srv, request, "stream reached its maximum age, reconnect to rebalance")
+			reason = "rebalance"
+			break timed
+		case <-srv.Context().Done(): // Activated when ctx.Done() closes
+			sublogger.Info().Msgf("Closing FetchWebhookEvents (client context %s closed)", request.ClientId)
+			reason = "client closed"
+			break timed
+		case <-ctx.Done(): // Activated when ctx.Done() closes
+			sublogger.Info().Msg("Closing FetchWebhookEvents (main context closed)")
+			sendDrainingNotice(srv, request, "server is shutting down")
+			reason = "shutdown"
+			break timed
+		}
 
-			events, err := retrieveCachedEventsForRepository(request.RepositoryId)
+		var childSpan trace.Span
+		if otelEnabled {
+			_, childSpan = tracer.Start(parentSpanContext, "retrieveCachedEventsForRepository", trace.WithSpanKind(trace.SpanKindServer))
+		}
 
-			if err != nil {
-				sublogger.Info().Msgf("Could not get events for Repo: %v\n", err)
-				otel_util.SetSpanStatus(childSpan, codes.Error, "Could not get events for Repo")
-				return err
-			}
-			response := &api.WebhookEventsResponse{
-				WebhookEvents: events,
-			}
+		sublogger.Info().Msgf("Fetching events for repo %v (with Span)", repositories)
 
-			if err := srv.Send(response); err != nil {
-				sublogger.Info().Msgf("Error sending stream: %v\n", err)
-				otel_util.SetSpanStatus(childSpan, codes.Error, "Error sending stream")
-				return err
-			}
-			sublogger.Info().Msgf("Send %v events to client (%v) for repo %v", len(events), request.ClientId, request.RepositoryId)
+		events, nextCursors, err := retrieveCachedEventsForRepositories(repositoryIds, cursors, mayFetch)
+		if request.GetAcknowledgeEvents() && sent {
+			// unacknowledged events stay pending, but are only sent again on a new stream
+			events = eventsAfter(events, cursors)
+		}
 
+		if err != nil {
+			sublogger.Info().Msgf("Could not get events for Repo: %v\n", err)
+			otel_util.SetSpanStatus(childSpan, codes.Error, "Could not get events for Repo")
+			return err
+		}
+		if len(events) == 0 && !heartbeatDue && request.GetTypedResponses() {
+			// the events we were told about were already sent, by this or another stream
 			if otelEnabled {
-				counter.Add(srv.Context(), int64(len(events)))
+				childSpan.End()
 			}
-			updateRelayStatus(events, request.RepositoryId)
-			otel_util.AddSpanEventWithOption(childSpan, "SendEvents", trace.WithAttributes(attribute.Int("events", len(events))))
+			continue
+		}
+		response := eventsResponse(events, request.GetTypedResponses())
 
-			if otelEnabled {
-				childSpan.End()
+		if err := srv.Send(response); err != nil {
+			sublogger.Info().Msgf("Error sending stream: %v\n", err)
+			otel_util.SetSpanStatus(childSpan, codes.Error, "Error sending stream")
+			return err
+		}
+		sublogger.Info().Msgf("Send %v events to client (%v) for repo %v", len(events), request.ClientId, repositories)
+
+		if otelEnabled {
+			for _, event := range events {
+				counter.Add(srv.Context(), 1, repositoryAttributes(event.RepositoryId))
 			}
+		}
+		if !request.GetAcknowledgeEvents() {
+			updateRelayStatus(events)
+		}
+		sent = true
+		cursors = nextCursors
+		touchRegistrations(repositoryIds)
+		otel_util.AddSpanEventWithOption(childSpan, "SendEvents", trace.WithAttributes(attribute.Int("events", len(events))))
 
-		case <-srv.Context().Done(): // Activated when ctx.Done() closes
-			sublogger.Info().Msgf("Closing FetchWebhookEvents (client context %s closed)", request.ClientId)
-			break timed
-		case <-ctx.Done(): // Activated when ctx.Done() closes
-			sublogger.Info().Msg("Closing FetchWebhookEvents (main context closed)")
-			break timed
+		if otelEnabled {
+			childSpan.End()
 		}
+		heartbeat.Reset(s.ResponseInterval)
 	}
-	sublogger.Info().Msgf("Reached %v, so closed context %s", finish, request.ClientId)
+	sublogger.Info().Msgf("Closed stream of client %s (%s)", request.ClientId, reason)
 	if otelEnabled {
-		span.AddEvent("Finished", trace.WithAttributes(attribute.String("reason", "timeout")))
+		span.AddEvent("Finished", trace.WithAttributes(attribute.String("reason", reason)))
 		span.SetStatus(codes.Ok, "Finished")
 	}
 	return nil
 }
 
-func retrieveCachedEventsForRepository(repositoryId string) ([]*api.WebhookEvent, error) {
+// eventsResponse wraps the events in the response the client understands, which is a heartbeat when there are none
+func eventsResponse(events []*api.WebhookEvent, typed bool) *api.WebhookEventsResponse {
+	if !typed {
+		return &api.WebhookEventsResponse{WebhookEvents: events}
+	}
+	if len(events) == 0 {
+		heartbeat := &api.Heartbeat{SentAtUnixMillis: time.Now().UnixMilli()}
+		return &api.WebhookEventsResponse{Payload: &api.WebhookEventsResponse_Heartbeat{Heartbeat: heartbeat}}
+	}
+	batch := &api.WebhookEventBatch{WebhookEvents: events}
+	return &api.WebhookEventsResponse{Payload: &api.WebhookEventsResponse_Events{Events: batch}}
+}
+
+// sendDrainingNotice asks the client to reconnect, as the server stops serving its stream. Clients that do not
+// understand notices see the stream end, and reconnect all the same.
+func sendDrainingNotice(srv api.Gitstafette_FetchWebhookEventsServer, request *api.WebhookEventsRequest, description string) {
+	if !request.GetTypedResponses() {
+		return
+	}
+	notice := &api.ServerNotice{Kind: api.NoticeKind_NOTICE_KIND_DRAINING, Description: description}
+	response := &api.WebhookEventsResponse{Payload: &api.WebhookEventsResponse_Notice{Notice: notice}}
+	if err := srv.Send(response); err != nil {
+		log.Printf("Could not send draining notice to client (%v): %v", request.ClientId, err)
+	}
+}
+
+// subscribedRepositories returns the repositories of the request, its repository_id followed by its repository_ids
+func subscribedRepositories(request *api.WebhookEventsRequest) []string {
+	repositoryIds := make([]string, 0, 1+len(request.GetRepositoryIds()))
+	for _, repositoryId := range append([]string{request.GetRepositoryId()}, request.GetRepositoryIds()...) {
+		repositoryId = cache.ResolveRepositoryID(repositoryId)
+		if repositoryId != "" && !slices.Contains(repositoryIds, repositoryId) {
+			repositoryIds = append(repositoryIds, repositoryId)
+		}
+	}
+	return repositoryIds
+}
+
+func describeRepositories(repositoryIds []string) string {
+	descriptions := make([]string, 0, len(repositoryIds))
+	for _, repositoryId := range repositoryIds {
+		descriptions = append(descriptions, cache.DescribeRepository(repositoryId))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+func touchRegistrations(repositoryIds []string) {
+	for _, repositoryId := range repositoryIds {
+		cache.Registrations.Touch(repositoryId)
+	}
+}
+
+// retrieveCachedEventsForRepositories returns the pending events of the repositories, where a pattern stands for every
+// watched repository matching it, with the cursors per repository after them
+func retrieveCachedEventsForRepositories(repositoryIds []string, cursors map[string]uint64, mayFetch func(repositoryId string) bool) ([]*api.WebhookEvent, map[string]uint64, error) {
 	events := make([]*api.WebhookEvent, 0)
-	if !cache.Repositories.RepositoryIsWatched(repositoryId) {
-		return events, fmt.Errorf("cannot fetch events for empty repository id")
+	if len(repositoryIds) == 0 {
+		return events, cursors, fmt.Errorf("cannot fetch events for empty repository id")
 	}
-	cachedEvents := cache.Store.RetrieveEventsForRepository(repositoryId)
-	for _, cachedEvent := range cachedEvents {
-		if cachedEvent.IsRelayed {
-			log.Printf("Event is already relayed: %v", cachedEvent)
-			continue
+	matchingRepositoryIds := make([]string, 0, len(repositoryIds))
+	for _, repositoryId := range repositoryIds {
+		isPattern := cache.IsRepositoryPattern(repositoryId)
+		if !isPattern && !cache.Repositories.RepositoryIsWatched(repositoryId) {
+			return events, cursors, fmt.Errorf("cannot fetch events for repository %v, it is not watched", repositoryId)
+		}
+		for _, matchingRepositoryId := range cache.MatchingRepositories(repositoryId) {
+			if isPattern && (!cache.Repositories.RepositoryIsWatched(matchingRepositoryId) || !mayFetch(matchingRepositoryId)) {
+				continue
+			}
+			if !slices.Contains(matchingRepositoryIds, matchingRepositoryId) {
+				matchingRepositoryIds = append(matchingRepositoryIds, matchingRepositoryId)
+			}
 		}
-		event := api.InternalToExternalEvent(cachedEvent)
-		events = append(events, event)
 	}
-	return events, nil
+
+	nextCursors := maps.Clone(cursors)
+	for _, matchingRepositoryId := range matchingRepositoryIds {
+		cachedEvents, nextCursor := cache.PendingEvents(matchingRepositoryId, cursors[matchingRepositoryId])
+		for _, cachedEvent := range cachedEvents {
+			event := api.InternalToExternalEvent(cachedEvent)
+			event.RepositoryId = matchingRepositoryId
+			// only learned from verified webhooks, so the client can trust it to resolve the names it was given
+			event.RepositoryName, _ = cache.Names.Name(matchingRepositoryId)
+			events = append(events, event)
+		}
+		nextCursors[matchingRepositoryId] = nextCursor
+	}
+	return events, nextCursors, nil
+}
+
+// repositoryAttributes labels metrics with the repository, and its full name once known
+func repositoryAttributes(repositoryId string) otelmetric.MeasurementOption {
+	name, _ := cache.Names.Name(repositoryId)
+	return otelmetric.WithAttributes(attribute.String("repository.id", repositoryId), attribute.String("repository.name", name))
 }
 
-func updateRelayStatus(events []*api.WebhookEvent, repositoryId string) {
-	cachedEvents := cache.Store.RetrieveEventsForRepository(repositoryId)
+// eventsAfter returns the events after the cursor of their repository
+func eventsAfter(events []*api.WebhookEvent, cursors map[string]uint64) []*api.WebhookEvent {
+	after := make([]*api.WebhookEvent, 0, len(events))
 	for _, event := range events {
-		eventId := event.EventId
-		for _, cachedEvent := range cachedEvents {
-			if cachedEvent.ID == eventId {
-				cachedEvent.IsRelayed = true
-				cachedEvent.TimeRelayed = time.Now()
-			}
+		if event.Sequence > cursors[event.RepositoryId] {
+			after = append(after, event)
 		}
 	}
+	return after
+}
+
+func updateRelayStatus(events []*api.WebhookEvent) {
+	for _, event := range events {
+		cache.Store.MarkRelayed(event.RepositoryId, event.EventId)
+	}
 }
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	api "github.com/joostvdg/gitstafette/api/v1"
+	"github.com/joostvdg/gitstafette/internal/auth"
+	"github.com/joostvdg/gitstafette/internal/cache"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetrieveCachedEventsAuthorizesPatternMatches(t *testing.T) {
+	cache.InitCache("myorg/*", nil)
+	names := map[string]string{"1": "myorg/app1", "2": "myorg/app10", "3": "myorg/other"}
+	for repositoryId, name := range names {
+		cache.LearnRepositoryName(repositoryId, name)
+		cache.Store.Store(repositoryId, &api.WebhookEventInternal{ID: "event-" + repositoryId})
+	}
+
+	authorizer, err := auth.NewAuthorizer([]*auth.Client{{ClientID: "client-1", Token: "token"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer.ResolveRepositoriesWith(cache.RepositoryAliases)
+	identity := &auth.Identity{ClientID: "client-1", Method: "token", Fetch: []string{"myorg/app?"}}
+	mayFetch := func(repositoryId string) bool {
+		return authorizer.Authorize(identity, auth.PermissionFetch, "client-1", repositoryId) == nil
+	}
+
+	events, _, err := retrieveCachedEventsForRepositories([]string{"myorg/app*"}, map[string]uint64{}, mayFetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositoryIds := make([]string, 0, len(events))
+	for _, event := range events {
+		repositoryIds = append(repositoryIds, event.RepositoryId)
+	}
+	if !slices.Equal(repositoryIds, []string{"1"}) {
+		t.Errorf("events of repositories %v, want only those of [1]", repositoryIds)
+	}
+	if len(events) == 1 && events[0].RepositoryName != "myorg/app1" {
+		t.Errorf("event repository name = %q, want myorg/app1", events[0].RepositoryName)
+	}
+}
+
+func TestRegisterClientKeyOwner(t *testing.T) {
+	cache.InitCache("1234", nil)
+	newPublicKey := func() []byte {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.PublicKey().Bytes()
+	}
+	server := GitstafetteServer{}
+
+	tests := []struct {
+		name     string
+		identity *auth.Identity
+		clientId string
+		code     grpccodes.Code
+		owner    string
+	}{
+		{name: "without authentication", clientId: "client-1", code: grpccodes.FailedPrecondition},
+		{name: "identity of any client", identity: &auth.Identity{Method: "token"}, clientId: "client-1", code: grpccodes.PermissionDenied},
+		{name: "for another client", identity: &auth.Identity{ClientID: "client-2", Method: "token"}, clientId: "client-1", code: grpccodes.PermissionDenied},
+		{name: "for itself", identity: &auth.Identity{ClientID: "client-1", Method: "token"}, clientId: "client-1", code: grpccodes.OK, owner: "client-1"},
+		{name: "without client id", identity: &auth.Identity{ClientID: "client-1", Method: "token"}, code: grpccodes.OK, owner: "client-1"},
+		{name: "held by another client", identity: &auth.Identity{ClientID: "client-2", Method: "token"}, code: grpccodes.PermissionDenied, owner: "client-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.identity != nil {
+				ctx = auth.ContextWithIdentity(ctx, tt.identity)
+			}
+			_, err := server.RegisterClientKey(ctx, &api.RegisterClientKeyRequest{
+				ClientId:     tt.clientId,
+				RepositoryId: "1234",
+				PublicKey:    newPublicKey(),
+			})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("RegisterClientKey() code = %v (%v), want %v", code, err, tt.code)
+			}
+			key, ok := cache.ClientKeys.Lookup("1234")
+			owner := ""
+			if ok {
+				owner = key.ClientID
+			}
+			if owner != tt.owner {
+				t.Errorf("key of repository 1234 belongs to %q, want %q", owner, tt.owner)
+			}
+		})
+	}
+}